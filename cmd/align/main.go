@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"image"
 	"image/png"
+	"log"
 	"os"
 
 	starpack "github.com/Coornail/starpack/lib"
@@ -11,10 +12,16 @@ import (
 )
 
 func main() {
-	ref := starpack.LoadImage(os.Args[1])
-	target := starpack.LoadImage(os.Args[2])
+	ref, err := starpack.LoadImage(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	target, err := starpack.LoadImage(os.Args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	sm1, _ := starpack.GetStarmap(ref, 0)
+	sm1, sigma := starpack.GetStarmap(ref, 0)
 	sm2, _ := starpack.GetStarmap(target, 0)
 
 	m1 := starmap.Starmap{
@@ -28,19 +35,34 @@ func main() {
 	}
 
 	diff := starmap.Starmaps{sm1, sm2}.VisualizeDifference()
-	f, _ := os.Create("./difference.png")
+	f, err := os.Create("./difference.png")
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer f.Close()
 	png.Encode(f, diff)
 
 	offset, _ := m1.FindOffset(m2)
-	fmt.Printf("%#v\n", offset)
-	m2 = m2.Offset(float64(offset.X), float64(offset.Y))
-	m2 = m2.Rotate(offset.Rotation)
+	fmt.Println(offset)
+	m2 = m2.Transform(offset)
 
 	sm2.Stars = m2.Stars
 
 	diff = starmap.Starmaps{sm1, sm2}.VisualizeDifference()
-	f2, _ := os.Create("./difference_after.png")
+	f2, err := os.Create("./difference_after.png")
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer f2.Close()
 	png.Encode(f2, diff)
+
+	// The stars of both frames, and the residuals of the matched pairs after the alignment the stacker would use.
+	config := starpack.FindOffset(sm1, sigma, target)
+	fmt.Println(config)
+	if err := starpack.WriteOverlay("./overlay_reference.png", ref, sm1, sigma, starmap.OffsetConfig{}); err != nil {
+		log.Fatal(err)
+	}
+	if err := starpack.WriteOverlay("./overlay.png", target, sm1, sigma, config); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	starpack "github.com/Coornail/starpack/lib"
 )
 
 func main() {
-	mask := starpack.EstimateLightPollutionMask(starpack.LoadImage(os.Args[1]))
-	starpack.SaveImage(os.Args[2], mask)
+	img, err := starpack.LoadImage(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mask := starpack.EstimateLightPollutionMask(img)
+	if err := starpack.SaveImage(os.Args[2], mask); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,14 +1,71 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	starpack "github.com/Coornail/starpack/lib"
+	"github.com/Coornail/starpack/starmap"
 )
 
+// Writes a star catalog of every input image, see starmap.Starmap.WriteCatalog.
 func main() {
-	img := starpack.LoadImage(os.Args[1])
-	sm := starpack.GetStarmap(img)
+	var outputDir, format string
+	var limit int
+	var writeImage bool
+	flag.StringVar(&outputDir, "output", "", "Directory to write the catalogs to, defaults to the directory of each image")
+	flag.StringVar(&format, "format", starmap.FormatJSON, "Catalog format (json, csv)")
+	flag.IntVar(&limit, "limit", 0, "Keep only this many of the brightest stars (0 keeps every star)")
+	flag.BoolVar(&writeImage, "image", false, "Also draw the detected stars into a .stars.png next to each catalog")
+	flag.Float64Var(&starpack.DetectionSigma, "detectionSigma", 5, "Detect stars this many sigmas of the local noise above the local background, lower finds fainter stars")
+	flag.StringVar(&starpack.PSF, "psf", starpack.PSFNone, "Profile fitted to detected stars for their position and shape (none, gaussian, moffat)")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	sm.WriteFile("./out.png")
+	if _, err := (starmap.Starmap{}).MarshalCatalog(format); err != nil {
+		log.Fatal(err)
+	}
+	if err := starpack.CheckPSF(starpack.PSF); err != nil {
+		log.Fatal(err)
+	}
+
+	files, err := starpack.CollectFiles(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, file := range files {
+		img, err := starpack.LoadImage(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sm, _ := starpack.DetectStars(img, 0)
+		if limit > 0 && len(sm.Stars) > limit {
+			sm.Stars = sm.Stars[:limit]
+		}
+
+		dir := outputDir
+		if dir == "" {
+			dir = filepath.Dir(file)
+		}
+		base := filepath.Join(dir, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+
+		catalog := base + "." + format
+		if err := sm.WriteCatalog(catalog); err != nil {
+			log.Fatal(err)
+		}
+		if writeImage {
+			if err := sm.WriteFile(base + ".stars.png"); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("%s: %d stars in %s\n", file, len(sm.Stars), catalog)
+	}
 }
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"runtime/pprof"
-	"sync"
+	"strings"
 
 	"github.com/Coornail/starpack/colr"
+	"github.com/Coornail/starpack/debayer"
 	starpack "github.com/Coornail/starpack/lib"
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
 )
 
 var (
@@ -22,6 +29,34 @@ var (
 	align                bool
 	mergeMethod          string
 	outputFile           string
+	biasFrames           string
+	darkFrames           string
+	flatFrames           string
+	masterMergeMethod    string
+	masterDir            string
+	darkScaling          bool
+	darkOptimize         bool
+	bayerPattern         string
+	debayerMethod        string
+	bayerDrizzle         bool
+	drizzleScale         float64
+	pixFrac              float64
+	drizzleWeights       string
+	sigmaLow             float64
+	sigmaHigh            float64
+	percentileLow        float64
+	percentileHigh       float64
+	clipIterations       int
+	statistics           bool
+	weighting            string
+	rejectFrames         float64
+	keepBest             float64
+	perceptual           bool
+	progress             = &printProgress{}
+	maxMemory            int
+	skipBadFrames        bool
+	cacheDir             string
+	debugOverlays        string
 )
 
 func verboseOutput(format string, args ...interface{}) {
@@ -31,17 +66,65 @@ func verboseOutput(format string, args ...interface{}) {
 }
 
 func main() {
-	flag.BoolVar(&supersample, "supersample", false, "Supersample image")
+	flag.BoolVar(&supersample, "supersample", false, "Supersample image with drizzle integration")
+	flag.Float64Var(&drizzleScale, "drizzleScale", 2, "Output pixels per input pixel when supersampling")
+	flag.Float64Var(&pixFrac, "pixfrac", 0.7, "Drop size relative to the input pixel when supersampling")
+	flag.StringVar(&drizzleWeights, "drizzleWeights", "", "Write the drizzle weight map to this file")
 	flag.BoolVar(&align, "align", false, "Align stars")
 	flag.BoolVar(&verbose, "verbose", true, "Verbose output")
 	flag.BoolVar(&whiteBalance, "whiteBalance", false, "White balancing") // @probabaly not worth it
 	flag.BoolVar(&denoise, "denoise", false, "Denoise input images")
 	flag.BoolVar(&removeLightPollution, "removeLightPollution", true, "Remove light pollution")
-	flag.StringVar(&mergeMethod, "mergeMethod", "average", "Method to merge pixels from the input images (median, average, brightest)")
-	flag.StringVar(&outputFile, "output", "output.tif", "Output file name")
+	flag.StringVar(&mergeMethod, "mergeMethod", "average", "Method to merge pixels from the input images (median, average, brightest, contrast, sigma, winsorized, percentile, linearfit)")
+	flag.Float64Var(&sigmaLow, "sigmaLow", 4, "Reject pixels this many sigmas below the center (sigma, winsorized, linearfit)")
+	flag.Float64Var(&sigmaHigh, "sigmaHigh", 3, "Reject pixels this many sigmas above the center (sigma, winsorized, linearfit)")
+	flag.Float64Var(&percentileLow, "percentileLow", 0.2, "Reject pixels this fraction below the median (percentile)")
+	flag.Float64Var(&percentileHigh, "percentileHigh", 0.1, "Reject pixels this fraction above the median (percentile)")
+	flag.IntVar(&clipIterations, "clipIterations", 5, "Maximum number of clipping passes")
+	flag.StringVar(&biasFrames, "bias", "", "Bias frames or a master bias (file or directory)")
+	flag.StringVar(&darkFrames, "darks", "", "Dark frames or a master dark (file or directory)")
+	flag.StringVar(&flatFrames, "flats", "", "Flat frames or a master flat (file or directory)")
+	flag.BoolVar(&perceptual, "perceptual", false, "Average in HCL and take the median in Lab instead of per linear RGB channel")
+	flag.StringVar(&masterMergeMethod, "masterMergeMethod", "median", "Method to merge calibration frames into masters (median, average)")
+	flag.StringVar(&masterDir, "masterDir", "", "Save the master calibration frames to this directory for reuse")
+	flag.BoolVar(&darkScaling, "darkScaling", false, "Scale the master dark by exposure time and sensor temperature")
+	flag.BoolVar(&darkOptimize, "darkOptimize", false, "Search for the dark scale that minimizes noise in each calibrated frame")
+	flag.StringVar(&bayerPattern, "bayerPattern", "", "Bayer pattern of one-shot-color data (RGGB, BGGR, GRBG, GBRG), defaults to the FITS BAYERPAT header")
+	flag.StringVar(&debayerMethod, "debayer", debayer.MethodBilinear, "Debayering method (bilinear, vng, superpixel)")
+	flag.BoolVar(&bayerDrizzle, "bayerDrizzle", false, "Integrate undebayered frames with bayer drizzle instead of debayering them")
+	flag.StringVar(&weighting, "weighting", starpack.WeightingNone, "Weigh frames by measured quality (none, fwhm, stars, noise, snr, combined)")
+	flag.Float64Var(&rejectFrames, "rejectFrames", 0, "Reject frames this many sigmas worse than the median in star count, FWHM, eccentricity, background or alignment (0 disables)")
+	flag.Float64Var(&keepBest, "keepBest", 100, "Keep only the best percentage of the frames")
+	flag.BoolVar(&statistics, "statistics", false, "Write rejection, contributing frame and noise maps next to the output")
+	flag.IntVar(&maxMemory, "maxMemory", 0, "Stream the frames through a disk cache, holding at most this many megabytes of them in memory (0 loads every frame)")
+	flag.StringVar(&cacheDir, "cacheDir", "", "Directory for the frame cache of -maxMemory, defaults to a temporary directory")
+	flag.BoolVar(&skipBadFrames, "skipBadFrames", false, "Log and leave out the files that cannot be read instead of stopping")
+	flag.StringVar(&starpack.AlignmentModel, "alignModel", starmap.ModelAuto, "Transformation fitted to the matched stars (translation, similarity, affine, homography, auto)")
+	flag.Float64Var(&starpack.DetectionSigma, "detectionSigma", 5, "Detect stars this many sigmas of the local noise above the local background, lower finds fainter stars")
+	flag.StringVar(&starpack.PSF, "psf", starpack.PSFNone, "Profile fitted to detected stars for their position and shape (none, gaussian, moffat)")
+	flag.StringVar(&starpack.Interpolation, "interpolation", starpack.InterpolationLanczos3, "Interpolation of aligned frames (nearest, bilinear, bicubic, lanczos3, lanczos4)")
+	flag.BoolVar(&starpack.ClampInterpolation, "clampInterpolation", true, "Keep interpolated values within the range of the closest pixels, against ringing around bright stars")
+	flag.IntVar(&starpack.Threads, "threads", runtime.GOMAXPROCS(0), "Number of worker threads")
+	flag.StringVar(&debugOverlays, "debugOverlays", "", "Save an overlay of the detected stars and their alignment residuals on every frame to this directory")
+	flag.StringVar(&outputFile, "output", "output.tif", "Output file name (.tif, .fits or .xisf)")
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	flag.Parse()
 
+	if err := starmap.CheckModel(starpack.AlignmentModel); err != nil {
+		log.Fatal(err)
+	}
+	if err := starpack.CheckPSF(starpack.PSF); err != nil {
+		log.Fatal(err)
+	}
+	if err := starpack.CheckWeighting(weighting); err != nil {
+		log.Fatal(err)
+	}
+	if supersample {
+		if err := (starpack.DrizzleOptions{Scale: drizzleScale, PixFrac: pixFrac}).Check(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if *cpuprofile != "" {
 		go func() {
 			log.Println(http.ListenAndServe("localhost:6060", nil))
@@ -57,8 +140,10 @@ func main() {
 		}
 		defer pprof.StopCPUProfile()
 	}
+	var history starpack.History
 	flag.VisitAll(func(f *flag.Flag) {
 		verboseOutput("%s:\t%v\n", f.Name, f.Value)
+		history.Flags = append(history.Flags, fmt.Sprintf("-%s=%v", f.Name, f.Value))
 	})
 
 	images := flag.Args()
@@ -67,64 +152,483 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Interrupting stops the running stage.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	files, err := starpack.CollectFiles(images)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var calibration *starpack.Calibration
+	if biasFrames != "" || darkFrames != "" || flatFrames != "" {
+		bias, _ := loadMaster(ctx, "bias", biasFrames)
+		dark, darkMetadata := loadMaster(ctx, "dark", darkFrames)
+		flat, _ := loadMaster(ctx, "flat", flatFrames)
+		calibration, err = starpack.NewCalibration(bias, dark, flat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		calibration.DarkMetadata = darkMetadata
+	}
+
+	if maxMemory > 0 {
+		output, err := streamStack(ctx, files, calibration, &history)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeOutput(output, history)
+		return
+	}
+
 	verboseOutput("Loading images\n")
-	loadedImages := starpack.LoadImages(images)
+	files, loadedImages := loadFrames(ctx, files)
 	verboseOutput("Loaded %d images\n", len(loadedImages))
 
-	var wg sync.WaitGroup
+	if calibration != nil {
+		verboseOutput("Calibrating\n")
+		err := starpack.ParallelFrames(ctx, 0, len(loadedImages), func(i int) {
+			calibrated, err := calibrate(calibration, files[i], loadedImages[i])
+			if err != nil {
+				log.Fatal(err)
+			}
+			loadedImages[i] = calibrated
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Bayer drizzle integrates the raw frames, the debayered ones are only used to find the offsets.
+	var cfaFrames []*planar.Image
+	var cfaPattern debayer.Pattern
+
+	if bayerPattern != "" || starpack.ReadMetadata(files[0]).BayerPattern != "" {
+		verboseOutput("Debayering\n")
+		// The offsets found on the debayered frames are applied to the raw ones, they have to keep their size.
+		method := debayerMethod
+		if bayerDrizzle {
+			cfaFrames = append(cfaFrames, loadedImages...)
+			method = debayer.MethodBilinear
+		}
+
+		cfaPattern = framePattern(files[0])
+		err := starpack.ParallelFrames(ctx, 0, len(loadedImages), func(i int) {
+			debayered, err := debayer.Debayer(loadedImages[i], framePattern(files[i]), method)
+			if err != nil {
+				log.Fatal(err)
+			}
+			loadedImages[i] = debayered
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if bayerDrizzle {
+		log.Fatal("-bayerDrizzle needs a bayer pattern from -bayerPattern or the FITS BAYERPAT header")
+	}
 
 	if denoise {
 		verboseOutput("Denoising\n")
-		for i := range loadedImages {
-			wg.Add(1)
-			go func(i int) {
-				loadedImages[i] = starpack.DenoiseImage(loadedImages[i])
-				wg.Done()
-			}(i)
+		err := starpack.ParallelFrames(ctx, 0, len(loadedImages), func(i int) {
+			denoised, err := starpack.DenoiseImage(ctx, loadedImages[i], nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			loadedImages[i] = denoised
+		})
+		if err != nil {
+			log.Fatal(err)
 		}
-		wg.Wait()
 	}
 
 	if removeLightPollution {
 		verboseOutput("Removing light pollution\n")
 		mask := starpack.EstimateLightPollutionMask(loadedImages[0])
-		for i := range loadedImages {
-			wg.Add(1)
-			go func(i int) {
-				loadedImages[i] = starpack.RemoveLightPollutionImage(loadedImages[i], mask)
-				wg.Done()
-			}(i)
+		err := starpack.ParallelFrames(ctx, 0, len(loadedImages), func(i int) {
+			loadedImages[i] = starpack.RemoveLightPollutionImage(loadedImages[i], mask)
+		})
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
+
+	if rejectFrames > 0 || keepBest < 100 {
+		verboseOutput("Selecting frames\n")
+		selections := starpack.SelectFrames(starpack.ScoreFrames(loadedImages), starpack.SelectionOptions{Sigma: rejectFrames, KeepBest: keepBest / 100})
+
+		var keptFiles []string
+		var keptImages, keptCFA []*planar.Image
+		for i := range selections {
+			if !selections[i].Keep {
+				fmt.Printf("Rejected %s: %s\n", files[i], strings.Join(selections[i].Reasons, ", "))
+				continue
+			}
 
-		wg.Wait()
+			keptFiles = append(keptFiles, files[i])
+			keptImages = append(keptImages, loadedImages[i])
+			if cfaFrames != nil {
+				keptCFA = append(keptCFA, cfaFrames[i])
+			}
+		}
+
+		if len(keptImages) == 0 {
+			log.Fatal("every frame was rejected")
+		}
+		files, loadedImages, cfaFrames = keptFiles, keptImages, keptCFA
+		verboseOutput("Kept %d of %d frames\n", len(keptImages), len(selections))
 	}
 
-	if supersample {
-		verboseOutput("Upscaling\n")
-		loadedImages = starpack.Upscale(loadedImages)
+	if statistics && (cfaFrames != nil || supersample) {
+		log.Printf("-statistics ignores drizzle, no statistics maps are written")
 	}
 
-	if align {
-		verboseOutput("Aligning\n")
-		loadedImages = starpack.StarTrack(loadedImages)
+	// Frames are weighed before they are warped, the uncovered edges of aligned frames would count as background.
+	var weights []float64
+	if weighting != starpack.WeightingNone {
+		weights = frameWeights(ctx, files, loadedImages)
 	}
 
-	var colorMergeMethod starpack.ColorMerge = starpack.MedianColor
-	if mergeMethod == "average" {
-		colorMergeMethod = starpack.AverageColor
-	} else if mergeMethod == "brightest" {
-		colorMergeMethod = starpack.BrightestColor
-	} else if mergeMethod == "contrast" {
-		colorMergeMethod = starpack.ContrastColor
+	var output *planar.Image
+	if cfaFrames != nil {
+		verboseOutput("Bayer drizzling\n")
+		history.Offsets, err = starpack.FindOffsets(ctx, loadedImages, progress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printOffsets(files, history.Offsets)
+		writeOverlays(files, loadedImages, history.Offsets)
+		output, err = starpack.BayerDrizzle(ctx, cfaFrames, cfaPattern, history.Offsets, weights, progress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		history.MergeMethod = "bayer drizzle"
+	} else if supersample {
+		verboseOutput("Drizzling\n")
+		history.Offsets = make([]starmap.OffsetConfig, len(loadedImages))
+		if align {
+			history.Offsets, err = starpack.FindOffsets(ctx, loadedImages, progress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printOffsets(files, history.Offsets)
+			writeOverlays(files, loadedImages, history.Offsets)
+		}
+
+		var weightMap *planar.Image
+		output, weightMap, err = starpack.Drizzle(ctx, loadedImages, history.Offsets, weights, starpack.DrizzleOptions{Scale: drizzleScale, PixFrac: pixFrac}, progress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		history.MergeMethod = fmt.Sprintf("drizzle scale=%g pixfrac=%g", drizzleScale, pixFrac)
+
+		if drizzleWeights != "" {
+			if err := starpack.SaveImage(drizzleWeights, weightMap); err != nil {
+				log.Printf("could not save drizzle weights: %s", err)
+			}
+		}
+	} else {
+		if align {
+			verboseOutput("Aligning\n")
+			// StarTrack replaces the frames with the aligned ones, the overlays are drawn on the originals.
+			unaligned := append([]*planar.Image(nil), loadedImages...)
+			loadedImages, history.Offsets, err = starpack.StarTrack(ctx, loadedImages, progress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printOffsets(files, history.Offsets)
+			writeOverlays(files, unaligned, history.Offsets)
+		}
+
+		merge, weighted := mergeByName(mergeMethod)
+		if weights != nil && !weighted {
+			log.Printf("merge method %s ignores frame weights", mergeMethodName())
+			weights = nil
+		}
+
+		if statistics {
+			result, err := starpack.StarpackStatistics(ctx, loadedImages, weights, merge, progress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			output = result.Image
+			writeStatistics(result)
+		} else {
+			var rejections []starpack.Rejection
+			output, rejections, err = starpack.StarpackRejection(ctx, loadedImages, weights, merge, progress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if rejectionMergeByName(mergeMethod) != nil {
+				printRejections(rejections, len(loadedImages))
+			}
+		}
+		history.MergeMethod = mergeMethodName()
 	}
+	history.Frames = len(loadedImages)
 
-	output := starpack.Starpack(loadedImages, colorMergeMethod)
+	writeOutput(output, history)
+}
 
+func writeOutput(output *planar.Image, history starpack.History) {
 	if whiteBalance {
 		verboseOutput("White balancing\n")
 		output = colr.ModifiedGrayWorld(output)
 	}
 
 	verboseOutput("Writing output\n")
-	starpack.SaveImage(outputFile, output)
+	if err := starpack.SaveImageWithHistory(outputFile, output, history); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// calibrate applies the master frames, with the dark scaled if -darkScaling or -darkOptimize is set.
+func calibrate(calibration *starpack.Calibration, file string, img *planar.Image) (*planar.Image, error) {
+	darkScale := 1.0
+	if darkScaling {
+		darkScale = calibration.DarkScale(starpack.ReadMetadata(file))
+	}
+	if darkOptimize {
+		darkScale = calibration.OptimizeDarkScale(img, darkScale)
+	}
+	if darkScaling || darkOptimize {
+		verboseOutput("Dark scale for %s: %.3f\n", file, darkScale)
+	}
+
+	calibrated, err := calibration.ApplyScaled(img, darkScale)
+	if err != nil {
+		return nil, fmt.Errorf("calibrating %s: %v", file, err)
+	}
+
+	return calibrated, nil
+}
+
+// framePattern is the bayer pattern of a frame, from -bayerPattern or its header.
+func framePattern(file string) debayer.Pattern {
+	pattern := bayerPattern
+	if pattern == "" {
+		pattern = starpack.ReadMetadata(file).BayerPattern
+	}
+
+	p, err := debayer.ParsePattern(pattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return p
+}
+
+func colorMergeMethodByName(name string) starpack.ColorMerge {
+	var colorMergeMethod starpack.ColorMerge = starpack.LinearMedianColor
+	if perceptual {
+		colorMergeMethod = starpack.MedianColor
+	}
+
+	if name == "average" {
+		colorMergeMethod = starpack.LinearAverageColor
+		if perceptual {
+			colorMergeMethod = starpack.AverageColor
+		}
+	} else if name == "brightest" {
+		colorMergeMethod = starpack.BrightestColor
+	} else if name == "contrast" {
+		colorMergeMethod = starpack.ContrastColor
+	}
+
+	return colorMergeMethod
+}
+
+// mergeMethodName is the -mergeMethod as recorded in the history.
+func mergeMethodName() string {
+	if perceptual {
+		return mergeMethod + " (perceptual)"
+	}
+
+	return mergeMethod
+}
+
+// mergeByName is the merge of a -mergeMethod, and whether it weighs the frames by -weighting and by their coverage.
+func mergeByName(name string) (starpack.RejectionMerge, bool) {
+	if merge := rejectionMergeByName(name); merge != nil {
+		return merge, true
+	}
+	if !perceptual {
+		switch name {
+		case "average":
+			return starpack.WeightedAverageColor, true
+		case "median":
+			return starpack.WeightedMedianColor, true
+		}
+	}
+
+	return starpack.NoRejection(colorMergeMethodByName(name)), false
+}
+
+// rejectionMergeByName returns nil for merge methods without rejection.
+func rejectionMergeByName(name string) starpack.RejectionMerge {
+	options := starpack.ClipOptions{Low: sigmaLow, High: sigmaHigh, Iterations: clipIterations}
+
+	switch name {
+	case "sigma":
+		return starpack.SigmaClipColor(options)
+	case "winsorized":
+		return starpack.WinsorizedSigmaClipColor(options)
+	case "linearfit":
+		return starpack.LinearFitClipColor(options)
+	case "percentile":
+		options.Low, options.High = percentileLow, percentileHigh
+		return starpack.PercentileClipColor(options)
+	}
+
+	return nil
+}
+
+func printRejections(rejections []starpack.Rejection, frames int) {
+	var low, high int
+	for i := range rejections {
+		low += rejections[i].Low
+		high += rejections[i].High
+	}
+
+	total := float64(len(rejections) * frames)
+	verboseOutput("Rejected %.3f%% low, %.3f%% high\n", float64(low)/total*100, float64(high)/total*100)
+}
+
+// loadFrames loads the files, with -skipBadFrames the ones that cannot be read are logged and left out.
+func loadFrames(ctx context.Context, files []string) ([]string, []*planar.Image) {
+	images, err := starpack.LoadImages(ctx, files, progress)
+	frameErrors, ok := err.(starpack.FrameErrors)
+	if err != nil && (!ok || !skipBadFrames) {
+		log.Fatal(err)
+	}
+
+	var keptFiles []string
+	var keptImages []*planar.Image
+	for i := range files {
+		if err, bad := frameErrors[files[i]]; bad {
+			log.Printf("Skipping %s", err)
+			continue
+		}
+		keptFiles = append(keptFiles, files[i])
+		keptImages = append(keptImages, images[i])
+	}
+
+	if len(keptImages) == 0 {
+		log.Fatal("no frames could be loaded")
+	}
+
+	return keptFiles, keptImages
+}
+
+func printOffsets(files []string, offsets []starmap.OffsetConfig) {
+	for i := range offsets {
+		verboseOutput("Offset of %s: %s\n", files[i], offsets[i])
+	}
+}
+
+// writeOverlays saves the overlay of every frame before alignment if -debugOverlays is set, see starpack.WriteOverlay.
+func writeOverlays(files []string, images []*planar.Image, offsets []starmap.OffsetConfig) {
+	if debugOverlays == "" {
+		return
+	}
+
+	referenceMap, sigma := starpack.GetStarmap(images[0], 0)
+	for i := range images {
+		writeOverlay(files[i], images[i], referenceMap, sigma, offsets[i])
+	}
+}
+
+func writeOverlay(file string, img *planar.Image, referenceMap starmap.Starmap, sigma float64, offset starmap.OffsetConfig) {
+	fileName := filepath.Join(debugOverlays, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))+".overlay.png")
+	verboseOutput("Writing %s\n", fileName)
+	if err := starpack.WriteOverlay(fileName, img, referenceMap, sigma, offset); err != nil {
+		log.Printf("could not save overlay: %s", err)
+	}
+}
+
+// frameWeights measures every frame and weighs them with the -weighting scheme.
+func frameWeights(ctx context.Context, files []string, images []*planar.Image) []float64 {
+	verboseOutput("Measuring frames\n")
+	_, sigma := starpack.GetStarmap(images[0], 0)
+
+	qualities := make([]starpack.FrameQuality, len(images))
+	err := starpack.ParallelFrames(ctx, 0, len(images), func(i int) {
+		qualities[i] = starpack.MeasureFrame(images[i], sigma)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	weights, err := starpack.FrameWeights(qualities, weighting)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := range weights {
+		q := qualities[i]
+		verboseOutput("Weight %.3f for %s (stars: %d, FWHM: %.2f, noise: %.5f, SNR: %.2f)\n",
+			weights[i], files[i], q.Stars, q.FWHM, q.Noise, q.SNR)
+	}
+
+	return weights
+}
+
+// writeStatistics saves the statistics maps next to the output, with the same format.
+func writeStatistics(result *starpack.StackResult) {
+	verboseOutput("SNR: %.2f\n", result.SNR)
+
+	ext := filepath.Ext(outputFile)
+	base := strings.TrimSuffix(outputFile, ext)
+	maps := map[string]*planar.Image{
+		"low":          result.LowRejection,
+		"high":         result.HighRejection,
+		"contributing": result.Contributing,
+		"noise":        result.Noise,
+	}
+
+	for name, img := range maps {
+		fileName := base + "_" + name + ext
+		verboseOutput("Writing %s\n", fileName)
+		if err := starpack.SaveImage(fileName, img); err != nil {
+			log.Printf("could not save %s: %s", fileName, err)
+		}
+	}
+}
+
+// loadMaster builds a master calibration frame, and saves it if -masterDir is set.
+func loadMaster(ctx context.Context, kind, path string) (*planar.Image, starpack.Metadata) {
+	if path == "" {
+		return nil, starpack.Metadata{}
+	}
+
+	files, err := starpack.CollectFiles([]string{path})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files, frames := loadFrames(ctx, files)
+	metadata := make([]starpack.Metadata, len(files))
+	for i := range files {
+		metadata[i] = starpack.ReadMetadata(files[i])
+	}
+	verboseOutput("Building master %s from %d frames\n", kind, len(frames))
+	// Calibration has to stay linear, even when the lights are merged perceptually.
+	var merge starpack.ColorMerge = starpack.LinearMedianColor
+	if masterMergeMethod == "average" {
+		merge = starpack.LinearAverageColor
+	}
+	master, err := starpack.MasterFrame(ctx, frames, merge, progress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if masterDir != "" && len(frames) > 1 {
+		fileName := filepath.Join(masterDir, "master_"+kind+".fits")
+		verboseOutput("Writing %s\n", fileName)
+		history := starpack.History{MergeMethod: masterMergeMethod, Frames: len(frames), Metadata: starpack.AverageMetadata(metadata)}
+		if err := starpack.SaveImageWithHistory(fileName, master, history); err != nil {
+			log.Printf("could not save master %s: %s", kind, err)
+		}
+	}
+
+	return master, starpack.AverageMetadata(metadata)
 }
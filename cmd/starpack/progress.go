@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// printProgress prints the progress of the library stages on a single line with -verbose.
+type printProgress struct {
+	mu    sync.Mutex
+	stage string
+	done  int
+}
+
+func (p *printProgress) Progress(stage string, done, total int) {
+	if !verbose {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Workers can report out of order.
+	if stage == p.stage && done <= p.done {
+		return
+	}
+	if stage != p.stage && p.stage != "" && p.done > 0 {
+		fmt.Printf("\n")
+	}
+	p.stage, p.done = stage, done
+
+	fmt.Printf("%s: %.2f%%\r", stage, float64(done)/float64(total)*100.0)
+	if done == total {
+		fmt.Printf("\n")
+		p.stage, p.done = "", 0
+	}
+}
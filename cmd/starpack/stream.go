@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Coornail/starpack/debayer"
+	starpack "github.com/Coornail/starpack/lib"
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+)
+
+// streamStack loads, preprocesses and aligns one frame at a time for -maxMemory.
+// Averages are accumulated as the frames come, other merge methods go through a frame cache on disk
+// and are merged a band of rows at a time.
+func streamStack(ctx context.Context, files []string, calibration *starpack.Calibration, history *starpack.History) (*planar.Image, error) {
+	if supersample || bayerDrizzle || statistics || weighting != starpack.WeightingNone || rejectFrames > 0 || keepBest < 100 {
+		log.Printf("-maxMemory ignores drizzle, statistics, frame weighting and frame selection")
+	}
+
+	incremental := mergeMethod == "average" && !perceptual
+	var mean starpack.MeanStack
+	var cache *starpack.FrameCache
+	if !incremental {
+		var err error
+		cache, err = starpack.NewFrameCache(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		defer cache.Close()
+	}
+
+	var frames int
+	var mask *planar.Image
+	var referenceMap starmap.Starmap
+	var sigma float64
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		verboseOutput("Processing %s (%d/%d)\n", file, i+1, len(files))
+		img, err := starpack.LoadImage(file)
+		if err != nil {
+			if !skipBadFrames {
+				return nil, err
+			}
+			log.Printf("Skipping %s", err)
+			continue
+		}
+		frames++
+
+		if calibration != nil {
+			calibrated, err := calibrate(calibration, file, img)
+			if err != nil {
+				return nil, err
+			}
+			img = calibrated
+		}
+
+		if bayerPattern != "" || starpack.ReadMetadata(file).BayerPattern != "" {
+			debayered, err := debayer.Debayer(img, framePattern(file), debayerMethod)
+			if err != nil {
+				return nil, err
+			}
+			img = debayered
+		}
+
+		if denoise {
+			denoised, err := starpack.DenoiseImage(ctx, img, nil)
+			if err != nil {
+				return nil, err
+			}
+			img = denoised
+		}
+
+		if removeLightPollution {
+			if mask == nil {
+				mask = starpack.EstimateLightPollutionMask(img)
+			}
+			img = starpack.RemoveLightPollutionImage(img, mask)
+		}
+
+		if align {
+			var offset starmap.OffsetConfig
+			if frames == 1 {
+				referenceMap, sigma = starpack.GetStarmap(img, 0)
+				if debugOverlays != "" {
+					writeOverlay(file, img, referenceMap, sigma, offset)
+				}
+			} else {
+				offset = starpack.FindOffset(referenceMap, sigma, img)
+				verboseOutput("Offset of %s: %s\n", file, offset)
+				if debugOverlays != "" {
+					writeOverlay(file, img, referenceMap, sigma, offset)
+				}
+				aligned, err := starpack.Transform(img, offset)
+				if err != nil {
+					return nil, err
+				}
+				img = aligned
+			}
+			history.Offsets = append(history.Offsets, offset)
+		}
+
+		if incremental {
+			mean.Add(img, 1)
+			continue
+		}
+		if err := cache.Add(img); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	if frames == 0 {
+		return nil, errors.New("no frames could be loaded")
+	}
+
+	history.Frames = frames
+	history.MergeMethod = mergeMethodName()
+	if incremental {
+		return mean.Image(), nil
+	}
+
+	merge, _ := mergeByName(mergeMethod)
+
+	verboseOutput("Merging %d cached frames\n", cache.Len())
+	return starpack.StarpackTiled(ctx, cache, nil, merge, int64(maxMemory)<<20, progress)
+}
@@ -0,0 +1,223 @@
+package debayer
+
+import (
+	"image"
+	"math"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+const (
+	MethodBilinear   = "bilinear"
+	MethodVNG        = "vng"
+	MethodSuperPixel = "superpixel"
+)
+
+// VNG gradient threshold: k1 * min + k2 * (max - min).
+const (
+	vngK1 = 1.5
+	vngK2 = 0.5
+)
+
+// Debayer demosaics img with the given method name.
+func Debayer(img image.Image, pattern Pattern, method string) (*planar.Image, error) {
+	switch method {
+	case MethodBilinear:
+		return Bilinear(img, pattern), nil
+	case MethodVNG:
+		return VNG(img, pattern), nil
+	case MethodSuperPixel:
+		return SuperPixel(img, pattern), nil
+	}
+
+	return nil, errors.Errorf("unknown debayer method: %q", method)
+}
+
+// Bilinear interpolates the missing channels from the neighbours that sampled them.
+func Bilinear(img image.Image, pattern Pattern) *planar.Image {
+	c := newCFA(img, pattern)
+	output := planar.New(image.Rect(0, 0, c.width, c.height), 3)
+
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			set(output, x, y, c.bilinear(x, y))
+		}
+	}
+
+	return output
+}
+
+func (c *cfa) bilinear(x, y int) [3]float64 {
+	var sum [3]float64
+	var count [3]float64
+
+	for j := -1; j <= 1; j++ {
+		for i := -1; i <= 1; i++ {
+			ch := c.color(x+i, y+j)
+			sum[ch] += c.at(x+i, y+j)
+			count[ch]++
+		}
+	}
+
+	// The sampled channel is not interpolated.
+	own := c.color(x, y)
+	sum[own], count[own] = c.at(x, y), 1
+
+	for ch := range sum {
+		sum[ch] /= count[ch]
+	}
+
+	return sum
+}
+
+// SuperPixel merges every 2x2 cell into a single pixel, halving the resolution without interpolation.
+func SuperPixel(img image.Image, pattern Pattern) *planar.Image {
+	c := newCFA(img, pattern)
+	output := planar.New(image.Rect(0, 0, c.width/2, c.height/2), 3)
+
+	for y := 0; y < c.height/2; y++ {
+		for x := 0; x < c.width/2; x++ {
+			var v [3]float64
+			for j := 0; j < 2; j++ {
+				for i := 0; i < 2; i++ {
+					v[c.color(2*x+i, 2*y+j)] += c.at(2*x+i, 2*y+j)
+				}
+			}
+			// Two green pixels per cell.
+			v[green] /= 2
+			set(output, x, y, v)
+		}
+	}
+
+	return output
+}
+
+type direction struct {
+	dx, dy int
+}
+
+var vngDirections = []direction{
+	{0, -1}, {1, -1}, {1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1},
+}
+
+// VNG is variable number of gradients interpolation (Chang, Cheung, Pang 1999).
+// It only averages along the directions with small gradients, which keeps stars and edges sharp.
+func VNG(img image.Image, pattern Pattern) *planar.Image {
+	c := newCFA(img, pattern)
+	output := planar.New(image.Rect(0, 0, c.width, c.height), 3)
+
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			set(output, x, y, c.vng(x, y))
+		}
+	}
+
+	return output
+}
+
+func (c *cfa) vng(x, y int) [3]float64 {
+	var gradients [8]float64
+	minGradient, maxGradient := math.Inf(1), math.Inf(-1)
+	for i, d := range vngDirections {
+		gradients[i] = c.gradient(x, y, d)
+		minGradient = math.Min(minGradient, gradients[i])
+		maxGradient = math.Max(maxGradient, gradients[i])
+	}
+
+	threshold := vngK1*minGradient + vngK2*(maxGradient-minGradient)
+
+	var sum [3]float64
+	var count float64
+	for i, d := range vngDirections {
+		if gradients[i] > threshold {
+			continue
+		}
+
+		v := c.directionColor(x, y, d)
+		for ch := range sum {
+			sum[ch] += v[ch]
+		}
+		count++
+	}
+
+	own := c.color(x, y)
+	value := c.at(x, y)
+
+	var result [3]float64
+	for ch := range result {
+		// The differences between channels are interpolated, not the channels themselves.
+		result[ch] = value + (sum[ch]-sum[own])/count
+	}
+	result[own] = value
+
+	return result
+}
+
+func perpendicular(d direction) direction {
+	return direction{-d.dy, d.dx}
+}
+
+func diagonal(d direction) bool {
+	return d.dx != 0 && d.dy != 0
+}
+
+// gradient compares same-colored pixels along a direction in the 5x5 neighbourhood.
+func (c *cfa) gradient(x, y int, d direction) float64 {
+	diff := func(x1, y1, x2, y2 int) float64 {
+		return math.Abs(c.at(x1, y1) - c.at(x2, y2))
+	}
+
+	g := diff(x+d.dx, y+d.dy, x-d.dx, y-d.dy) + diff(x+2*d.dx, y+2*d.dy, x, y)
+
+	if diagonal(d) {
+		g += (diff(x+d.dx, y, x, y-d.dy) + diff(x, y+d.dy, x-d.dx, y)) / 2
+		return g
+	}
+
+	o := perpendicular(d)
+	g += (diff(x+d.dx+o.dx, y+d.dy+o.dy, x-d.dx+o.dx, y-d.dy+o.dy) +
+		diff(x+d.dx-o.dx, y+d.dy-o.dy, x-d.dx-o.dx, y-d.dy-o.dy)) / 2
+	g += (diff(x+2*d.dx+o.dx, y+2*d.dy+o.dy, x+o.dx, y+o.dy) +
+		diff(x+2*d.dx-o.dx, y+2*d.dy-o.dy, x-o.dx, y-o.dy)) / 2
+
+	return g
+}
+
+// directionColor averages each channel over the pixels lying in a direction.
+func (c *cfa) directionColor(x, y int, d direction) [3]float64 {
+	var sum, count [3]float64
+	add := func(px, py int) {
+		ch := c.color(px, py)
+		sum[ch] += c.at(px, py)
+		count[ch]++
+	}
+
+	add(x, y)
+	add(x+d.dx, y+d.dy)
+	add(x+2*d.dx, y+2*d.dy)
+
+	if diagonal(d) {
+		add(x+d.dx, y)
+		add(x, y+d.dy)
+	} else {
+		o := perpendicular(d)
+		add(x+d.dx+o.dx, y+d.dy+o.dy)
+		add(x+d.dx-o.dx, y+d.dy-o.dy)
+
+		// Green pixels have no red or blue along the cardinal directions,
+		// borrow them from the sides.
+		if count[c.color(x+o.dx, y+o.dy)] == 0 {
+			add(x+o.dx, y+o.dy)
+			add(x-o.dx, y-o.dy)
+		}
+	}
+
+	for ch := range sum {
+		if count[ch] > 0 {
+			sum[ch] /= count[ch]
+		}
+	}
+
+	return sum
+}
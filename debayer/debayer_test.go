@@ -0,0 +1,192 @@
+package debayer
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+// mosaic samples a flat colored field through a bayer filter.
+func mosaic(pattern Pattern, width, height int, c [3]uint16) *image.Gray16 {
+	return sample(pattern, width, height, func(x, y int) [3]uint16 { return c })
+}
+
+// placement is where red and blue are in the 2x2 cell of each pattern, written out independently of Pattern.Color.
+var placement = map[Pattern]struct{ red, blue image.Point }{
+	RGGB: {image.Pt(0, 0), image.Pt(1, 1)},
+	BGGR: {image.Pt(1, 1), image.Pt(0, 0)},
+	GRBG: {image.Pt(1, 0), image.Pt(0, 1)},
+	GBRG: {image.Pt(0, 1), image.Pt(1, 0)},
+}
+
+// sample takes the channel of the scene that the sensor records at every pixel.
+func sample(pattern Pattern, width, height int, scene func(x, y int) [3]uint16) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ch := green
+			switch image.Pt(x&1, y&1) {
+			case placement[pattern].red:
+				ch = red
+			case placement[pattern].blue:
+				ch = blue
+			}
+			img.SetGray16(x, y, color.Gray16{Y: scene(x, y)[ch]})
+		}
+	}
+
+	return img
+}
+
+// expectPixel compares the channels of a pixel to a 16 bit color.
+func expectPixel(t *testing.T, name string, output *planar.Image, x, y int, expected [3]uint16) {
+	t.Helper()
+	i := output.Offset(x, y)
+	for ch := range expected {
+		if v := float64(output.Channels[ch][i]); math.Abs(v-float64(expected[ch])/0xffff) > 1e-6 {
+			t.Errorf("%s: channel %d of pixel %d,%d is %f, expected %f", name, ch, x, y, v, float64(expected[ch])/0xffff)
+		}
+	}
+}
+
+func TestFlatField(t *testing.T) {
+	expected := [3]uint16{0x8000, 0x4000, 0x2000}
+
+	for _, pattern := range []Pattern{RGGB, BGGR, GRBG, GBRG} {
+		for _, method := range []string{MethodBilinear, MethodVNG, MethodSuperPixel} {
+			output, err := Debayer(mosaic(pattern, 8, 6, expected), pattern, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bounds := output.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					c := output.At(x, y).(color.RGBA64)
+					if c.R != expected[0] || c.G != expected[1] || c.B != expected[2] {
+						t.Fatalf("%s %s: pixel %d,%d is %v", pattern, method, x, y, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGradient(t *testing.T) {
+	// Every channel changes in a different direction, so a swapped channel or a wrong parity shows.
+	ramp := func(x, y int) [3]uint16 {
+		return [3]uint16{uint16(0x1000 + 0x400*x), uint16(0x2000 + 0x200*(x+y)), uint16(0x1000 + 0x300*y)}
+	}
+
+	for pattern, cell := range placement {
+		img := sample(pattern, 10, 8, ramp)
+
+		// Averaging the neighbours is exact on a linear ramp, away from the mirrored border.
+		output := Bilinear(img, pattern)
+		for y := 1; y < 7; y++ {
+			for x := 1; x < 9; x++ {
+				expectPixel(t, string(pattern)+" bilinear", output, x, y, ramp(x, y))
+			}
+		}
+
+		// A super pixel takes red and blue from where they are in its cell, and the mean of the two greens.
+		output = SuperPixel(img, pattern)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 5; x++ {
+				r, b := cell.red.Add(image.Pt(2*x, 2*y)), cell.blue.Add(image.Pt(2*x, 2*y))
+				expected := [3]uint16{ramp(r.X, r.Y)[red], uint16(0x2000 + 0x200*(2*x+2*y+1)), ramp(b.X, b.Y)[blue]}
+				expectPixel(t, string(pattern)+" superpixel", output, x, y, expected)
+			}
+		}
+	}
+}
+
+func TestEdge(t *testing.T) {
+	left, right := [3]uint16{0x9000, 0x6000, 0x3000}, [3]uint16{0x3000, 0x4000, 0x9000}
+	const edge = 6
+	vertical := func(x, y int) [3]uint16 {
+		if x < edge {
+			return left
+		}
+		return right
+	}
+	horizontal := func(x, y int) [3]uint16 { return vertical(y, x) }
+
+	for pattern, cell := range placement {
+		img := sample(pattern, 12, 8, vertical)
+		expected := func(x int) [3]uint16 { return vertical(x, 0) }
+
+		bilinear, vng := Bilinear(img, pattern), VNG(img, pattern)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 12; x++ {
+				// The columns next to the edge are interpolated across it.
+				if x == edge-1 || x == edge {
+					continue
+				}
+				expectPixel(t, string(pattern)+" bilinear", bilinear, x, y, expected(x))
+				expectPixel(t, string(pattern)+" vng", vng, x, y, expected(x))
+			}
+		}
+
+		superPixel := SuperPixel(img, pattern)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 6; x++ {
+				expectPixel(t, string(pattern)+" superpixel", superPixel, x, y, expected(2*x))
+			}
+		}
+
+		// VNG leaves out the directions that cross the edge, so it bleeds less than bilinear.
+		var bilinearError, vngError float64
+		for y := 0; y < 8; y++ {
+			for _, x := range []int{edge - 1, edge} {
+				b, v := bilinear.Offset(x, y), vng.Offset(x, y)
+				for ch, e := range expected(x) {
+					bilinearError += math.Abs(float64(bilinear.Channels[ch][b]) - float64(e)/0xffff)
+					vngError += math.Abs(float64(vng.Channels[ch][v]) - float64(e)/0xffff)
+				}
+			}
+		}
+		if vngError >= bilinearError {
+			t.Errorf("%s: VNG error on the edge is %f, bilinear is %f", pattern, vngError, bilinearError)
+		}
+
+		// The same edge turned horizontal, with the pattern transposed, is interpolated the same way.
+		var transposed Pattern
+		for p, c := range placement {
+			if c.red == image.Pt(cell.red.Y, cell.red.X) && c.blue == image.Pt(cell.blue.Y, cell.blue.X) {
+				transposed = p
+			}
+		}
+		turned := VNG(sample(transposed, 8, 12, horizontal), transposed)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 12; x++ {
+				a, b := vng.Offset(x, y), turned.Offset(y, x)
+				for ch := range vng.Channels {
+					if math.Abs(float64(vng.Channels[ch][a]-turned.Channels[ch][b])) > 1e-6 {
+						t.Errorf("%s: channel %d of pixel %d,%d is %f vertically and %f horizontally",
+							pattern, ch, x, y, vng.Channels[ch][a], turned.Channels[ch][b])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSuperPixelSize(t *testing.T) {
+	output := SuperPixel(image.NewGray16(image.Rect(0, 0, 10, 7)), RGGB)
+	if output.Bounds() != image.Rect(0, 0, 5, 3) {
+		t.Errorf("Unexpected size: %v", output.Bounds())
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	if p, err := ParsePattern(" rggb"); err != nil || p != RGGB {
+		t.Errorf("Expected RGGB, got %q (%v)", p, err)
+	}
+	if _, err := ParsePattern("RGBG"); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
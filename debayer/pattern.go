@@ -0,0 +1,114 @@
+// Package debayer turns color filter array (CFA) data from one-shot-color sensors into RGB images.
+package debayer
+
+import (
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+// Pattern is the color of the top-left 2x2 cell of the sensor, row by row.
+type Pattern string
+
+const (
+	RGGB Pattern = "RGGB"
+	BGGR Pattern = "BGGR"
+	GRBG Pattern = "GRBG"
+	GBRG Pattern = "GBRG"
+)
+
+const (
+	red = iota
+	green
+	blue
+)
+
+func ParsePattern(s string) (Pattern, error) {
+	p := Pattern(strings.ToUpper(strings.TrimSpace(s)))
+	switch p {
+	case RGGB, BGGR, GRBG, GBRG:
+		return p, nil
+	}
+
+	return "", errors.Errorf("unknown bayer pattern: %q", s)
+}
+
+// Color returns the channel (0 red, 1 green, 2 blue) that is sampled at the given position.
+func (p Pattern) Color(x, y int) int {
+	switch p[(y&1)*2+(x&1)] {
+	case 'R':
+		return red
+	case 'G':
+		return green
+	}
+
+	return blue
+}
+
+// cfa is the raw sensor data with mirrored borders.
+// Mirroring keeps the parity of the coordinates, so the pattern stays valid outside the image.
+type cfa struct {
+	width, height int
+	values        []float64
+	pattern       Pattern
+}
+
+func newCFA(img image.Image, pattern Pattern) *cfa {
+	bounds := img.Bounds()
+	c := &cfa{
+		width:   bounds.Dx(),
+		height:  bounds.Dy(),
+		values:  make([]float64, bounds.Dx()*bounds.Dy()),
+		pattern: pattern,
+	}
+
+	if p, ok := img.(planar.Planar); ok {
+		// Unclamped calibrated data, the sensor values are in the first channel.
+		for i, v := range p.PlanarImage().Channels[0] {
+			c.values[i] = float64(v)
+		}
+		return c
+	}
+
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			v := color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16).Y
+			c.values[y*c.width+x] = float64(v) / 0xffff
+		}
+	}
+
+	return c
+}
+
+func mirror(v, size int) int {
+	if v < 0 {
+		v = -v
+	}
+	if v >= size {
+		v = 2*(size-1) - v
+	}
+	if v < 0 || v >= size {
+		// Images narrower than the neighbourhood.
+		return v & 1
+	}
+
+	return v
+}
+
+func (c *cfa) at(x, y int) float64 {
+	return c.values[mirror(y, c.height)*c.width+mirror(x, c.width)]
+}
+
+func (c *cfa) color(x, y int) int {
+	return c.pattern.Color(x, y)
+}
+
+func set(img *planar.Image, x, y int, v [3]float64) {
+	i := img.Offset(x, y)
+	for ch := range v {
+		img.Channels[ch][i] = float32(v[ch])
+	}
+}
@@ -0,0 +1,280 @@
+package fits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+func testHeader(cards ...string) []byte {
+	var buf bytes.Buffer
+	for _, c := range append(cards, "END") {
+		buf.WriteString(fmt.Sprintf("%-80s", c))
+	}
+	for buf.Len()%blockSize != 0 {
+		buf.WriteByte(' ')
+	}
+
+	return buf.Bytes()
+}
+
+func pad(data []byte) []byte {
+	for len(data)%blockSize != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+func TestReadUnsigned16(t *testing.T) {
+	var data []byte
+	// Rows are stored bottom-up.
+	for _, v := range []uint16{0, 65535, 32768, 100} {
+		raw := make([]byte, 2)
+		binary.BigEndian.PutUint16(raw, uint16(int16(int(v)-32768)))
+		data = append(data, raw...)
+	}
+
+	file := append(testHeader(
+		"SIMPLE  =                    T",
+		"BITPIX  =                   16",
+		"NAXIS   =                    2",
+		"NAXIS1  =                    2",
+		"NAXIS2  =                    2",
+		"BZERO   =                32768",
+		"BSCALE  =                    1",
+		"EXPTIME =                120.5 / seconds",
+		"CCD-TEMP=                -10.0",
+		"DATE-OBS= '2020-08-12T22:10:05' / start of exposure",
+		"HISTORY dark subtracted",
+	), pad(data)...)
+
+	img, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds() != image.Rect(0, 0, 2, 2) || len(img.Channels) != 1 {
+		t.Fatalf("Unexpected geometry: %v, %d planes", img.Bounds(), len(img.Channels))
+	}
+
+	expected := map[image.Point]uint16{{0, 0}: 32768, {1, 0}: 100, {0, 1}: 0, {1, 1}: 65535}
+	for p, v := range expected {
+		if got := img.At(p.X, p.Y).(color.Gray16).Y; got != v {
+			t.Errorf("Pixel %v: expected %d, got %d", p, v, got)
+		}
+	}
+
+	if exp, _ := img.Header.ExposureTime(); exp != 120.5 {
+		t.Errorf("Expected EXPTIME 120.5, got %f", exp)
+	}
+	if temp, _ := img.Header.Temperature(); temp != -10 {
+		t.Errorf("Expected CCD-TEMP -10, got %f", temp)
+	}
+	if date, ok := img.Header.DateObs(); !ok || date.Hour() != 22 {
+		t.Errorf("Failed to parse DATE-OBS: %v", date)
+	}
+}
+
+func TestReadFloatColor(t *testing.T) {
+	var data []byte
+	for _, v := range []float32{0.25, 0.5, 0.75} {
+		raw := make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, math.Float32bits(v))
+		data = append(data, raw...)
+	}
+
+	file := append(testHeader(
+		"SIMPLE  =                    T",
+		"BITPIX  =                  -32",
+		"NAXIS   =                    3",
+		"NAXIS1  =                    1",
+		"NAXIS2  =                    1",
+		"NAXIS3  =                    3",
+	), pad(data)...)
+
+	decoded, format, err := image.Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "fits" {
+		t.Errorf("Expected fits format, got %s", format)
+	}
+
+	c := decoded.At(0, 0).(color.RGBA64)
+	if c.R != 16384 || c.G != 32768 || c.B != 49151 {
+		t.Errorf("Unexpected color %#v", c)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	src := image.NewRGBA64(image.Rect(0, 0, 3, 2))
+	for i := 6; i < len(src.Pix); i += 8 {
+		src.Pix[i], src.Pix[i+1] = 0xff, 0xff
+	}
+	src.Set(0, 0, color.RGBA64{R: 0xffff, A: 0xffff})
+	src.Set(2, 1, color.RGBA64{G: 0x8000, B: 0x4000, A: 0xffff})
+
+	var h Header
+	h.Set("NCOMBINE", "12", "number of stacked frames")
+	h.SetString("STACKMTH", "median", "")
+	h.AddHistory("offset x=1 y=-2 rotation=0.00")
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, h); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%blockSize != 0 {
+		t.Errorf("Output is not padded to whole blocks: %d", buf.Len())
+	}
+
+	img, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			if img.At(x, y) != src.At(x, y) {
+				t.Errorf("Pixel %d,%d: expected %v, got %v", x, y, src.At(x, y), img.At(x, y))
+			}
+		}
+	}
+
+	if n, _ := img.Header.Int("NCOMBINE"); n != 12 {
+		t.Errorf("Expected NCOMBINE 12, got %d", n)
+	}
+	if m, _ := img.Header.String("STACKMTH"); m != "median" {
+		t.Errorf("Expected STACKMTH median, got %q", m)
+	}
+	if v, _ := img.Header.Get("HISTORY"); v != "offset x=1 y=-2 rotation=0.00" {
+		t.Errorf("Unexpected HISTORY %q", v)
+	}
+}
+
+func TestEncodeTwoPlanes(t *testing.T) {
+	src := planar.New(image.Rect(0, 0, 2, 2), 2)
+	for ch := range src.Channels {
+		for i := range src.Channels[ch] {
+			src.Channels[ch][i] = float32(ch*4+i) / 8
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, Header{}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(img.Channels) != 2 {
+		t.Fatalf("expected 2 planes, got %d", len(img.Channels))
+	}
+	for ch := range src.Channels {
+		for i, v := range src.Channels[ch] {
+			if img.Channels[ch][i] != v {
+				t.Errorf("plane %d pixel %d: expected %f, got %f", ch, i, v, img.Channels[ch][i])
+			}
+		}
+	}
+}
+
+func TestBayerPattern(t *testing.T) {
+	cases := []struct {
+		cards    []Card
+		expected string
+	}{
+		{[]Card{{Key: "BAYERPAT", Value: "'RGGB'"}, {Key: "NAXIS2", Value: "3"}}, "RGGB"},
+		{[]Card{{Key: "BAYERPAT", Value: "'RGGB'"}, {Key: "NAXIS2", Value: "4"}}, "GBRG"},
+		{[]Card{{Key: "BAYERPAT", Value: "'RGGB'"}, {Key: "NAXIS2", Value: "4"}, {Key: "ROWORDER", Value: "'TOP-DOWN'"}}, "RGGB"},
+		{[]Card{{Key: "BAYERPAT", Value: "'RGGB'"}, {Key: "NAXIS2", Value: "3"}, {Key: "XBAYROFF", Value: "1"}}, "GRBG"},
+	}
+
+	for _, c := range cases {
+		if p, _ := (Header{Cards: c.cards}).BayerPattern(); p != c.expected {
+			t.Errorf("%v: expected %s, got %s", c.cards, c.expected, p)
+		}
+	}
+}
+
+func floatFrame(values ...float32) []byte {
+	var data []byte
+	for _, v := range values {
+		raw := make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, math.Float32bits(v))
+		data = append(data, raw...)
+	}
+
+	return append(testHeader(
+		"SIMPLE  =                    T",
+		"BITPIX  =                  -32",
+		"NAXIS   =                    2",
+		fmt.Sprintf("NAXIS1  = %20d", len(values)),
+		"NAXIS2  =                    1",
+	), pad(data)...)
+}
+
+func TestReadFloatADU(t *testing.T) {
+	// A dark and a light in ADU with different maxima, a pixel of 1000 ADU has to read the same in both.
+	for _, file := range [][]byte{floatFrame(1000, 2000), floatFrame(1000, 40000)} {
+		img, err := Read(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := img.Channels[0][0]; math.Abs(float64(v)-1000.0/floatADUMax) > 1e-7 {
+			t.Errorf("expected 1000 ADU to read as %f, got %f", 1000.0/floatADUMax, v)
+		}
+	}
+
+	// DATAMAX overrides the convention.
+	file := append(testHeader(
+		"SIMPLE  =                    T",
+		"BITPIX  =                  -32",
+		"NAXIS   =                    2",
+		"NAXIS1  =                    1",
+		"NAXIS2  =                    1",
+		"DATAMAX =                 4000",
+	), pad([]byte{0x44, 0x7a, 0, 0})...) // 1000
+	img, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := img.Channels[0][0]; v != 0.25 {
+		t.Errorf("expected 1000 of DATAMAX 4000 to read as 0.25, got %f", v)
+	}
+}
+
+func TestReadBlank(t *testing.T) {
+	var data []byte
+	for _, v := range []int16{-1, 100, -1} {
+		raw := make([]byte, 2)
+		binary.BigEndian.PutUint16(raw, uint16(v))
+		data = append(data, raw...)
+	}
+
+	file := append(testHeader(
+		"SIMPLE  =                    T",
+		"BITPIX  =                   16",
+		"NAXIS   =                    2",
+		"NAXIS1  =                    3",
+		"NAXIS2  =                    1",
+		"BZERO   =                32768",
+		"BLANK   =                   -1",
+	), pad(data)...)
+	img, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Undefined pixels are black, not 32767 ADU.
+	if p := img.Channels[0]; p[0] != 0 || p[2] != 0 || p[1] == 0 {
+		t.Errorf("expected the blank pixels at zero, got %v", p)
+	}
+}
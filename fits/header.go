@@ -0,0 +1,205 @@
+package fits
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	blockSize = 2880
+	cardSize  = 80
+)
+
+// Card is a single 80 character header record.
+type Card struct {
+	Key     string
+	Value   string
+	Comment string
+}
+
+// Header holds the keywords of a FITS header unit in file order.
+type Header struct {
+	Cards []Card
+}
+
+// Get returns the raw value of the first card with the given key.
+func (h Header) Get(key string) (string, bool) {
+	for i := range h.Cards {
+		if h.Cards[i].Key == key {
+			return h.Cards[i].Value, true
+		}
+	}
+
+	return "", false
+}
+
+// String returns a string keyword with the quotes and padding removed.
+func (h Header) String(key string) (string, bool) {
+	v, ok := h.Get(key)
+	if !ok {
+		return "", false
+	}
+
+	return unquote(v), true
+}
+
+func (h Header) Int(key string) (int, bool) {
+	v, ok := h.Get(key)
+	if !ok {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		// Some writers put integers in float notation.
+		f, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil {
+			return 0, false
+		}
+		return int(f), true
+	}
+
+	return i, true
+}
+
+func (h Header) Float(key string) (float64, bool) {
+	v, ok := h.Get(key)
+	if !ok {
+		return 0, false
+	}
+
+	// Fortran style exponents are allowed by the standard.
+	f, err := strconv.ParseFloat(strings.Replace(v, "D", "E", 1), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
+
+// ExposureTime in seconds.
+func (h Header) ExposureTime() (float64, bool) {
+	if v, ok := h.Float("EXPTIME"); ok {
+		return v, true
+	}
+
+	return h.Float("EXPOSURE")
+}
+
+func (h Header) Gain() (float64, bool) {
+	return h.Float("GAIN")
+}
+
+// Temperature of the sensor in Celsius.
+func (h Header) Temperature() (float64, bool) {
+	if v, ok := h.Float("CCD-TEMP"); ok {
+		return v, true
+	}
+
+	return h.Float("CCD_TEMP")
+}
+
+// DateObs is the start of the exposure.
+func (h Header) DateObs() (time.Time, bool) {
+	v, ok := h.String("DATE-OBS")
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// BayerPattern returns the color filter layout as seen in the decoded, top-down image.
+// The pattern is shifted by XBAYROFF/YBAYROFF and by the vertical flip of bottom-up files.
+func (h Header) BayerPattern() (string, bool) {
+	pattern, ok := h.String("BAYERPAT")
+	if !ok || len(pattern) != 4 {
+		return "", false
+	}
+	pattern = strings.ToUpper(pattern)
+
+	dx, _ := h.Int("XBAYROFF")
+	dy, _ := h.Int("YBAYROFF")
+
+	// Flipping an even number of rows moves the second row of the pattern to the top.
+	height, _ := h.Int("NAXIS2")
+	if order, _ := h.String("ROWORDER"); order != "TOP-DOWN" && height%2 == 0 {
+		dy++
+	}
+
+	if dx%2 != 0 {
+		pattern = pattern[1:2] + pattern[0:1] + pattern[3:4] + pattern[2:3]
+	}
+	if dy%2 != 0 {
+		pattern = pattern[2:4] + pattern[0:2]
+	}
+
+	return pattern, true
+}
+
+// Set replaces the value of an existing keyword or appends a new one.
+func (h *Header) Set(key, value, comment string) {
+	for i := range h.Cards {
+		if h.Cards[i].Key == key {
+			h.Cards[i].Value = value
+			h.Cards[i].Comment = comment
+			return
+		}
+	}
+
+	h.Cards = append(h.Cards, Card{Key: key, Value: value, Comment: comment})
+}
+
+func parseCard(raw string) Card {
+	key := strings.TrimSpace(raw[0:8])
+	if len(raw) < 10 || raw[8:10] != "= " {
+		// Commentary keywords (COMMENT, HISTORY, blank) carry free text.
+		return Card{Key: key, Value: strings.TrimRight(raw[8:], " ")}
+	}
+
+	rest := raw[10:]
+	trimmed := strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(trimmed, "'") {
+		// Quotes inside strings are escaped by doubling them.
+		for i := 1; i < len(trimmed); i++ {
+			if trimmed[i] != '\'' {
+				continue
+			}
+			if i+1 < len(trimmed) && trimmed[i+1] == '\'' {
+				i++
+				continue
+			}
+
+			card := Card{Key: key, Value: trimmed[:i+1]}
+			if slash := strings.Index(trimmed[i+1:], "/"); slash >= 0 {
+				card.Comment = strings.TrimSpace(trimmed[i+1+slash+1:])
+			}
+			return card
+		}
+
+		return Card{Key: key, Value: trimmed}
+	}
+
+	card := Card{Key: key, Value: strings.TrimSpace(rest)}
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		card.Value = strings.TrimSpace(rest[:slash])
+		card.Comment = strings.TrimSpace(rest[slash+1:])
+	}
+
+	return card
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		v = strings.Replace(v[1:len(v)-1], "''", "'", -1)
+	}
+
+	return strings.TrimRight(v, " ")
+}
@@ -0,0 +1,242 @@
+package fits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	image.RegisterFormat("fits", "SIMPLE  =", Decode, DecodeConfig)
+}
+
+// Image is the primary data unit of a FITS file.
+// Pixel values are normalized to [0, 1] but not clamped.
+// It has one channel for mono data, three (R, G, B) for color.
+type Image struct {
+	*planar.Image
+	Header Header
+}
+
+// Decode reads a FITS file as an image.Image.
+func Decode(r io.Reader) (image.Image, error) {
+	return Read(r)
+}
+
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := readHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	width, height, planes, err := dimensions(h)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	model := color.RGBA64Model
+	if planes < 3 {
+		model = color.Gray16Model
+	}
+
+	return image.Config{ColorModel: model, Width: width, Height: height}, nil
+}
+
+// Read decodes the primary header and data unit.
+func Read(r io.Reader) (*Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height, planes, err := dimensions(h)
+	if err != nil {
+		return nil, err
+	}
+
+	bitpix, _ := h.Int("BITPIX")
+	bytesPerPixel := abs(bitpix) / 8
+	if bytesPerPixel == 0 {
+		return nil, errors.Errorf("fits: unsupported BITPIX %d", bitpix)
+	}
+
+	bzero, ok := h.Float("BZERO")
+	if !ok {
+		bzero = 0
+	}
+	bscale, ok := h.Float("BSCALE")
+	if !ok {
+		bscale = 1
+	}
+
+	// BLANK marks undefined pixels of integer data, they are read as NaN.
+	blank, hasBlank := h.Int("BLANK")
+	hasBlank = hasBlank && bitpix > 0
+
+	planeSize := width * height
+	raw := make([]byte, planeSize*planes*bytesPerPixel)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return nil, errors.Wrap(err, "fits: reading data unit")
+	}
+
+	values := make([]float64, planeSize*planes)
+	for i := range values {
+		b := raw[i*bytesPerPixel:]
+		var v float64
+		switch bitpix {
+		case 8:
+			v = float64(b[0])
+		case 16:
+			v = float64(int16(binary.BigEndian.Uint16(b)))
+		case 32:
+			v = float64(int32(binary.BigEndian.Uint32(b)))
+		case -32:
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case -64:
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		default:
+			return nil, errors.Errorf("fits: unsupported BITPIX %d", bitpix)
+		}
+		if hasBlank && v == float64(blank) {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = bzero + bscale*v
+	}
+
+	lo, hi := physicalRange(h, bitpix, bzero, bscale, values)
+	scale := 1.0
+	if hi > lo {
+		scale = 1.0 / (hi - lo)
+	}
+
+	// FITS stores the bottom row first unless told otherwise.
+	bottomUp := true
+	if order, ok := h.String("ROWORDER"); ok && order == "TOP-DOWN" {
+		bottomUp = false
+	}
+
+	img := &Image{Image: planar.New(image.Rect(0, 0, width, height), planes), Header: h}
+	for p := 0; p < planes; p++ {
+		plane := img.Channels[p]
+		for y := 0; y < height; y++ {
+			srcY := y
+			if bottomUp {
+				srcY = height - 1 - y
+			}
+			for x := 0; x < width; x++ {
+				v := values[p*planeSize+srcY*width+x]
+				if math.IsNaN(v) {
+					v = lo
+				}
+				plane[y*width+x] = float32((v - lo) * scale)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// ReadHeader reads only the primary header, without the data.
+func ReadHeader(r io.Reader) (Header, error) {
+	return readHeader(r)
+}
+
+func readHeader(r io.Reader) (Header, error) {
+	var h Header
+	block := make([]byte, blockSize)
+
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			return h, errors.Wrap(err, "fits: reading header")
+		}
+
+		for i := 0; i < blockSize; i += cardSize {
+			card := parseCard(string(block[i : i+cardSize]))
+			if card.Key == "END" {
+				if len(h.Cards) == 0 || h.Cards[0].Key != "SIMPLE" {
+					return h, errors.New("fits: missing SIMPLE keyword")
+				}
+				return h, nil
+			}
+			h.Cards = append(h.Cards, card)
+		}
+	}
+}
+
+func dimensions(h Header) (width, height, planes int, err error) {
+	naxis, _ := h.Int("NAXIS")
+	width, _ = h.Int("NAXIS1")
+	height, _ = h.Int("NAXIS2")
+	planes = 1
+
+	switch naxis {
+	case 2:
+	case 3:
+		planes, _ = h.Int("NAXIS3")
+		if planes < 1 {
+			return 0, 0, 0, errors.Errorf("fits: unsupported number of planes %d", planes)
+		}
+	default:
+		return 0, 0, 0, errors.Errorf("fits: unsupported NAXIS %d", naxis)
+	}
+
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, errors.Errorf("fits: invalid dimensions %dx%d", width, height)
+	}
+
+	return width, height, planes, nil
+}
+
+// floatADUMax is white for floating point data in ADU without a DATAMAX.
+const floatADUMax = 65535
+
+// physicalRange finds the values that map to black and white.
+func physicalRange(h Header, bitpix int, bzero, bscale float64, values []float64) (float64, float64) {
+	var lo, hi float64
+	switch bitpix {
+	case 8:
+		lo, hi = bzero, bzero+255*bscale
+	case 16:
+		lo, hi = bzero+math.MinInt16*bscale, bzero+math.MaxInt16*bscale
+	case 32:
+		lo, hi = bzero+math.MinInt32*bscale, bzero+math.MaxInt32*bscale
+	default:
+		// Floating point data has no natural range, it is either normalized to [0, 1] or in ADU of a 16-bit camera.
+		// The range is fixed rather than taken from the data, so lights and masters of the same camera scale alike.
+		lo, hi = 0, 1
+		for _, v := range values {
+			if v > 1 {
+				hi = floatADUMax
+				break
+			}
+		}
+		if v, ok := h.Float("DATAMIN"); ok {
+			lo = v
+		}
+		if v, ok := h.Float("DATAMAX"); ok {
+			hi = v
+		}
+	}
+
+	// Astronomical data is non-negative, signed storage only wastes the lower half.
+	if lo < 0 && bitpix > 0 {
+		lo = 0
+	}
+
+	return lo, hi
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,134 @@
+package fits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+// Keywords describing the data layout, these are always generated by Encode.
+var structuralKeys = map[string]bool{
+	"SIMPLE":   true,
+	"BITPIX":   true,
+	"NAXIS":    true,
+	"NAXIS1":   true,
+	"NAXIS2":   true,
+	"NAXIS3":   true,
+	"EXTEND":   true,
+	"BZERO":    true,
+	"BSCALE":   true,
+	"ROWORDER": true,
+	"END":      true,
+}
+
+// SetString sets a keyword to a quoted string value.
+func (h *Header) SetString(key, value, comment string) {
+	h.Set(key, "'"+strings.Replace(value, "'", "''", -1)+"'", comment)
+}
+
+// AddHistory appends HISTORY cards, wrapping long lines.
+func (h *Header) AddHistory(text string) {
+	for len(text) > cardSize-8 {
+		h.Cards = append(h.Cards, Card{Key: "HISTORY", Value: text[:cardSize-8]})
+		text = text[cardSize-8:]
+	}
+	h.Cards = append(h.Cards, Card{Key: "HISTORY", Value: text})
+}
+
+// Encode writes img as 32-bit float FITS in [0, 1] with the keywords from h.
+func Encode(w io.Writer, img image.Image, h Header) error {
+	bounds := img.Bounds()
+	planes := planar.FromImage(img).Channels
+
+	out := Header{}
+	out.Set("SIMPLE", "T", "conforms to FITS standard")
+	out.Set("BITPIX", "-32", "32-bit floating point")
+	if len(planes) == 1 {
+		out.Set("NAXIS", "2", "")
+	} else {
+		out.Set("NAXIS", "3", "")
+	}
+	out.Set("NAXIS1", fmt.Sprintf("%d", bounds.Dx()), "")
+	out.Set("NAXIS2", fmt.Sprintf("%d", bounds.Dy()), "")
+	if len(planes) > 1 {
+		out.Set("NAXIS3", fmt.Sprintf("%d", len(planes)), "")
+	}
+	out.SetString("ROWORDER", "BOTTOM-UP", "")
+	for _, c := range h.Cards {
+		if !structuralKeys[c.Key] {
+			out.Cards = append(out.Cards, c)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeHeader(bw, out); err != nil {
+		return err
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	buf := make([]byte, 4)
+	for _, plane := range planes {
+		// Bottom row first.
+		for y := height - 1; y >= 0; y-- {
+			for x := 0; x < width; x++ {
+				binary.BigEndian.PutUint32(buf, math.Float32bits(plane[y*width+x]))
+				if _, err := bw.Write(buf); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	written := len(planes) * width * height * 4
+	if rem := written % blockSize; rem != 0 {
+		if _, err := bw.Write(make([]byte, blockSize-rem)); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, h Header) error {
+	var sb strings.Builder
+	for _, c := range append(h.Cards, Card{Key: "END"}) {
+		sb.WriteString(formatCard(c))
+	}
+	for sb.Len()%blockSize != 0 {
+		sb.WriteByte(' ')
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatCard(c Card) string {
+	var line string
+	switch {
+	case c.Key == "END":
+		line = "END"
+	case c.Key == "HISTORY" || c.Key == "COMMENT" || c.Key == "":
+		line = fmt.Sprintf("%-8s%s", c.Key, c.Value)
+	case strings.HasPrefix(c.Value, "'"):
+		// Strings start at column 11 and the closing quote is at column 20 or later.
+		line = fmt.Sprintf("%-8s= %-20s", c.Key, c.Value)
+	default:
+		line = fmt.Sprintf("%-8s= %20s", c.Key, c.Value)
+	}
+
+	if c.Comment != "" && c.Key != "HISTORY" && c.Key != "COMMENT" {
+		line += " / " + c.Comment
+	}
+
+	if len(line) > cardSize {
+		line = line[:cardSize]
+	}
+
+	return fmt.Sprintf("%-80s", line)
+}
@@ -0,0 +1,156 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// Size in pixels of the boxes the background is estimated in, like BACK_SIZE of SExtractor.
+	backgroundMeshSize = 64
+	// Pixels further than this many sigmas from the median are clipped, as stars, until none are.
+	backgroundClipSigma      = 3.0
+	backgroundClipIterations = 5
+	// Noise is never estimated below this, frames without noise would make every pixel significant.
+	minBackgroundNoise = 1e-4
+)
+
+// DetectionSigma is the default treshold of star detection, in sigmas of the local noise above the local background.
+var DetectionSigma = 5.0
+
+// backgroundMesh is the sky background and its noise on a grid of boxes, interpolated between their centers.
+type backgroundMesh struct {
+	bounds     image.Rectangle
+	cols, rows int
+	background []float64
+	noise      []float64
+}
+
+// newBackgroundMesh estimates the background and noise of the values, row by row, with sigma clipping in each box.
+// Boxes further than backgroundClipSigma from their neighbours are median filtered, so a big star or nebula does not pull a single box up.
+func newBackgroundMesh(values []float64, bounds image.Rectangle) *backgroundMesh {
+	m := &backgroundMesh{
+		bounds: bounds,
+		cols:   (bounds.Dx() + backgroundMeshSize - 1) / backgroundMeshSize,
+		rows:   (bounds.Dy() + backgroundMeshSize - 1) / backgroundMeshSize,
+	}
+	m.background = make([]float64, m.cols*m.rows)
+	m.noise = make([]float64, m.cols*m.rows)
+
+	width := bounds.Dx()
+	parallelRows(context.Background(), image.Rect(0, 0, m.cols, m.rows), func(minRow, maxRow int) {
+		box := make([]float64, 0, backgroundMeshSize*backgroundMeshSize)
+		for row := minRow; row < maxRow; row++ {
+			for col := 0; col < m.cols; col++ {
+				box = box[:0]
+				for y := row * backgroundMeshSize; y < min((row+1)*backgroundMeshSize, bounds.Dy()); y++ {
+					box = append(box, values[y*width+col*backgroundMeshSize:y*width+min((col+1)*backgroundMeshSize, width)]...)
+				}
+				m.background[row*m.cols+col], m.noise[row*m.cols+col] = clippedBackground(box)
+			}
+		}
+	})
+
+	tolerance := make([]float64, len(m.noise))
+	for i, noise := range m.noise {
+		tolerance[i] = backgroundClipSigma * noise
+	}
+	m.background = medianFilter(m.background, tolerance, m.cols, m.rows)
+	m.noise = medianFilter(m.noise, nil, m.cols, m.rows)
+
+	return m
+}
+
+// clippedBackground estimates the background and noise of a box, sorting it in place.
+// The background is the mode estimate of SExtractor, 2.5 median - 1.5 mean, unless the box is crowded.
+func clippedBackground(box []float64) (float64, float64) {
+	sort.Float64s(box)
+
+	for iteration := 0; iteration < backgroundClipIterations; iteration++ {
+		center := box[len(box)/2]
+		_, sigma := meanStdDev(box)
+		low := sort.SearchFloat64s(box, center-backgroundClipSigma*sigma)
+		high := sort.SearchFloat64s(box, math.Nextafter(center+backgroundClipSigma*sigma, math.Inf(1)))
+		if (low == 0 && high == len(box)) || high-low < 2 {
+			break
+		}
+		box = box[low:high]
+	}
+
+	mean, sigma := meanStdDev(box)
+	center := box[len(box)/2]
+	if sigma > 0 && math.Abs(mean-center)/sigma > 0.3 {
+		return center, math.Max(sigma, minBackgroundNoise)
+	}
+
+	return 2.5*center - 1.5*mean, math.Max(sigma, minBackgroundNoise)
+}
+
+func meanStdDev(values []float64) (float64, float64) {
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+		squares += v * v
+	}
+	n := float64(len(values))
+	mean := sum / n
+
+	return mean, math.Sqrt(math.Max(squares/n-mean*mean, 0))
+}
+
+// medianFilter replaces the cells of the grid with the median of their 3x3 neighbourhood,
+// only where they differ from it by more than the tolerance of the cell if there is one, to keep gradients intact.
+func medianFilter(grid, tolerance []float64, cols, rows int) []float64 {
+	output := make([]float64, len(grid))
+	var neighbourhood []float64
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			neighbourhood = neighbourhood[:0]
+			for y := max(row-1, 0); y <= min(row+1, rows-1); y++ {
+				for x := max(col-1, 0); x <= min(col+1, cols-1); x++ {
+					neighbourhood = append(neighbourhood, grid[y*cols+x])
+				}
+			}
+			i := row*cols + col
+			output[i] = median(neighbourhood)
+			if tolerance != nil && math.Abs(grid[i]-output[i]) <= tolerance[i] {
+				output[i] = grid[i]
+			}
+		}
+	}
+
+	return output
+}
+
+// at interpolates the grid bilinearly between the centers of the boxes, and extrapolates it past the outer ones.
+func (m *backgroundMesh) at(grid []float64, x, y int) float64 {
+	x0, x1, fx := meshCells((float64(x-m.bounds.Min.X)+0.5)/backgroundMeshSize-0.5, m.cols)
+	y0, y1, fy := meshCells((float64(y-m.bounds.Min.Y)+0.5)/backgroundMeshSize-0.5, m.rows)
+
+	top := grid[y0*m.cols+x0]*(1-fx) + grid[y0*m.cols+x1]*fx
+	bottom := grid[y1*m.cols+x0]*(1-fx) + grid[y1*m.cols+x1]*fx
+
+	return top*(1-fy) + bottom*fy
+}
+
+// meshCells are the two cells along an axis to interpolate position g between, and the weight of the second one.
+func meshCells(g float64, cells int) (int, int, float64) {
+	if cells == 1 {
+		return 0, 0, 0
+	}
+	first := min(max(int(math.Floor(g)), 0), cells-2)
+
+	return first, first + 1, g - float64(first)
+}
+
+// Background at a pixel.
+func (m *backgroundMesh) Background(x, y int) float64 {
+	return m.at(m.background, x, y)
+}
+
+// Noise is the standard deviation of the background at a pixel.
+func (m *backgroundMesh) Noise(x, y int) float64 {
+	return math.Max(m.at(m.noise, x, y), minBackgroundNoise)
+}
@@ -0,0 +1,258 @@
+package starpack
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Keep the division from blowing up in the dark corners of the flat.
+	minimumFlat = 0.01
+
+	// Dark current roughly doubles every this many degrees Celsius.
+	darkDoublingTemperature = 6.3
+
+	// Number of pixel pairs used to estimate the noise while optimizing the dark scale.
+	darkOptimizationSamples = 100000
+	darkOptimizationSteps   = 30
+)
+
+// Calibration holds the master frames that are applied to every light frame.
+// Any of them can be nil.
+type Calibration struct {
+	Bias *planar.Image
+	Dark *planar.Image
+	Flat *planar.Image
+
+	// Acquisition information of the master dark, used for scaling.
+	DarkMetadata Metadata
+
+	// (flat - bias) / mean per channel.
+	normalizedFlat [][]float32
+}
+
+// MasterFrame merges calibration frames into a master frame.
+// A single frame is treated as an already built master.
+func MasterFrame(ctx context.Context, frames []*planar.Image, colorMergeMethod ColorMerge, progress Progress) (*planar.Image, error) {
+	if len(frames) == 1 {
+		return frames[0], nil
+	}
+
+	return Starpack(ctx, frames, colorMergeMethod, progress)
+}
+
+// NewCalibration prepares the master frames, which have to be the same size.
+func NewCalibration(bias, dark, flat *planar.Image) (*Calibration, error) {
+	c := &Calibration{Bias: bias, Dark: dark, Flat: flat}
+	var size *planar.Image
+	for _, master := range c.masters() {
+		if size != nil && master.image.Rect != size.Rect {
+			return nil, errors.Errorf("master %s is %v, the others are %v", master.kind, master.image.Rect, size.Rect)
+		}
+		size = master.image
+	}
+	if flat == nil {
+		return c, nil
+	}
+
+	c.normalizedFlat = make([][]float32, len(flat.Channels))
+	for ch := range flat.Channels {
+		normalized := make([]float32, len(flat.Channels[ch]))
+		copy(normalized, flat.Channels[ch])
+		if bias != nil {
+			b := bias.Channel(ch)
+			for i := range normalized {
+				normalized[i] -= b[i]
+			}
+		}
+
+		var sum float64
+		for _, v := range normalized {
+			sum += float64(v)
+		}
+		mean := sum / float64(len(normalized))
+		if mean <= 0 {
+			mean = 1
+		}
+		for i := range normalized {
+			normalized[i] /= float32(mean)
+		}
+		c.normalizedFlat[ch] = normalized
+	}
+
+	return c, nil
+}
+
+type master struct {
+	kind  string
+	image *planar.Image
+}
+
+// masters are the master frames that are set.
+func (c *Calibration) masters() []master {
+	var masters []master
+	for _, m := range []master{{"bias", c.Bias}, {"dark", c.Dark}, {"flat", c.Flat}} {
+		if m.image != nil {
+			masters = append(masters, m)
+		}
+	}
+
+	return masters
+}
+
+// Check returns an error if the master frames do not fit the light frame:
+// they have to be the same size, and either monochrome or have as many channels.
+func (c *Calibration) Check(img *planar.Image) error {
+	for _, m := range c.masters() {
+		if m.image.Rect != img.Rect {
+			return errors.Errorf("master %s is %v, the light frame is %v", m.kind, m.image.Rect, img.Rect)
+		}
+		if n := len(m.image.Channels); n != 1 && n != len(img.Channels) {
+			return errors.Errorf("master %s has %d channels, the light frame has %d", m.kind, n, len(img.Channels))
+		}
+	}
+
+	return nil
+}
+
+// Apply calibrates a light frame: (light - dark) / normalize(flat - bias).
+// Without a dark the bias is subtracted instead, as the dark already contains it.
+func (c *Calibration) Apply(img *planar.Image) (*planar.Image, error) {
+	return c.ApplyScaled(img, 1)
+}
+
+// ApplyScaled calibrates a light frame with the thermal signal of the dark multiplied by darkScale:
+// light - bias - darkScale * (dark - bias).
+// Without a master bias the whole dark is scaled.
+// The result is not clamped, the noise of the background can go below zero.
+// It returns an error if the master frames do not fit the light frame, see Check.
+func (c *Calibration) ApplyScaled(img *planar.Image, darkScale float64) (*planar.Image, error) {
+	if err := c.Check(img); err != nil {
+		return nil, err
+	}
+
+	output := img.Copy()
+
+	for ch := range output.Channels {
+		v := output.Channels[ch]
+		for i := range v {
+			v[i] -= c.offset(ch, i, darkScale)
+		}
+
+		if c.Flat != nil {
+			flat := c.normalizedFlat[min(ch, len(c.normalizedFlat)-1)]
+			for i := range v {
+				v[i] /= float32(maxFloat(float64(flat[i]), minimumFlat))
+			}
+		}
+	}
+
+	return output, nil
+}
+
+// offset is the signal to subtract from a light frame at a given pixel of a channel.
+func (c *Calibration) offset(ch, i int, darkScale float64) float32 {
+	var b float32
+	if c.Bias != nil {
+		b = c.Bias.Channel(ch)[i]
+	}
+
+	if c.Dark == nil {
+		return b
+	}
+
+	return b + float32(darkScale)*(c.Dark.Channel(ch)[i]-b)
+}
+
+// DarkScale estimates how much of the master dark applies to a light frame
+// from the exposure times and sensor temperatures.
+func (c *Calibration) DarkScale(light Metadata) float64 {
+	scale := 1.0
+	if light.ExposureTime > 0 && c.DarkMetadata.ExposureTime > 0 {
+		scale = light.ExposureTime / c.DarkMetadata.ExposureTime
+	}
+
+	if light.HasTemperature && c.DarkMetadata.HasTemperature {
+		scale *= math.Pow(2, (light.Temperature-c.DarkMetadata.Temperature)/darkDoublingTemperature)
+	}
+
+	return scale
+}
+
+// OptimizeDarkScale searches for the dark scale around initial that leaves the least noise in the calibrated frame.
+// Noise is measured as the median absolute difference between horizontal neighbours, which ignores stars and gradients
+// but picks up hot pixels and amp glow that do not match the light frame. Frames too narrow to sample keep initial.
+func (c *Calibration) OptimizeDarkScale(img *planar.Image, initial float64) float64 {
+	if c.Dark == nil || c.Check(img) != nil {
+		return initial
+	}
+
+	bounds := img.Bounds()
+	step := int(math.Max(1, math.Sqrt(float64(bounds.Dx()*bounds.Dy())/darkOptimizationSamples)))
+
+	// Light minus bias and dark minus bias for each sampled pair.
+	var lights, darks [][2]float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X-1; x += step {
+			var l, d [2]float64
+			for i := 0; i < 2; i++ {
+				offset := img.Offset(x+i, y)
+				var b float64
+				if c.Bias != nil {
+					b = pixelLuminance(c.Bias, offset)
+				}
+				l[i] = pixelLuminance(img, offset) - b
+				d[i] = pixelLuminance(c.Dark, offset) - b
+			}
+			lights = append(lights, l)
+			darks = append(darks, d)
+		}
+	}
+	if len(lights) == 0 {
+		return initial
+	}
+
+	diffs := make([]float64, len(lights))
+	noise := func(k float64) float64 {
+		for i := range lights {
+			diffs[i] = math.Abs((lights[i][0] - k*darks[i][0]) - (lights[i][1] - k*darks[i][1]))
+		}
+		sort.Float64s(diffs)
+		return diffs[len(diffs)/2]
+	}
+
+	// Golden section search over [0, 2 * initial].
+	lo, hi := 0.0, 2*math.Max(initial, 0.5)
+	ratio := (math.Sqrt(5) - 1) / 2
+	a := hi - ratio*(hi-lo)
+	b := lo + ratio*(hi-lo)
+	na, nb := noise(a), noise(b)
+	for i := 0; i < darkOptimizationSteps; i++ {
+		if na < nb {
+			hi, b, nb = b, a, na
+			a = hi - ratio*(hi-lo)
+			na = noise(a)
+		} else {
+			lo, a, na = a, b, nb
+			b = lo + ratio*(hi-lo)
+			nb = noise(b)
+		}
+	}
+
+	return (lo + hi) / 2
+}
+
+func luminance(c [3]float64) float64 {
+	return c[0]*0.299 + c[1]*0.587 + c[2]*0.114
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,144 @@
+package starpack
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+// frameOf is a single row monochrome frame.
+func frameOf(values ...float32) *planar.Image {
+	img := planar.New(image.Rect(0, 0, len(values), 1), 1)
+	copy(img.Channels[0], values)
+
+	return img
+}
+
+func expectValues(t *testing.T, name string, img *planar.Image, expected ...float32) {
+	t.Helper()
+	for i, v := range expected {
+		if math.Abs(float64(img.Channels[0][i]-v)) > 1e-5 {
+			t.Errorf("%s: expected %v, got %v", name, expected, img.Channels[0])
+			return
+		}
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	light := frameOf(10, 20, 30, 40)
+
+	tests := []struct {
+		name             string
+		bias, dark, flat *planar.Image
+		darkScale        float64
+		expected         []float32
+	}{
+		{"bias only", frameOf(1, 2, 3, 4), nil, nil, 1, []float32{9, 18, 27, 36}},
+		// The dark already contains the bias, and without a master bias all of it is scaled.
+		{"dark without bias", nil, frameOf(2, 4, 6, 8), nil, 1, []float32{8, 16, 24, 32}},
+		{"scaled dark without bias", nil, frameOf(2, 4, 6, 8), nil, 0.5, []float32{9, 18, 27, 36}},
+		{"scaled dark with bias", frameOf(1, 1, 1, 1), frameOf(3, 5, 7, 9), nil, 0.5, []float32{8, 17, 26, 35}},
+		// flat - bias is 1, 3, 2, 2 with a mean of 2.
+		{"flat normalisation", frameOf(1, 1, 1, 1), nil, frameOf(2, 4, 3, 3), 1, []float32{18, 19.0 / 1.5, 29, 39}},
+		// The dead pixel of the flat is divided by minimumFlat instead of zero.
+		{"minimum flat", nil, nil, frameOf(0, 2, 1, 1), 1, []float32{10 / minimumFlat, 10, 30, 40}},
+	}
+
+	for _, test := range tests {
+		c, err := NewCalibration(test.bias, test.dark, test.flat)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		calibrated, err := c.ApplyScaled(light, test.darkScale)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		expectValues(t, test.name, calibrated, test.expected...)
+	}
+	expectValues(t, "light frame", light, 10, 20, 30, 40)
+}
+
+func TestCalibrationSizeMismatch(t *testing.T) {
+	small, large := planar.New(image.Rect(0, 0, 4, 4), 1), planar.New(image.Rect(0, 0, 8, 8), 1)
+
+	if _, err := NewCalibration(small, large, nil); err == nil {
+		t.Error("expected an error for masters of different sizes")
+	}
+
+	c, err := NewCalibration(nil, small, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Apply(large); err == nil {
+		t.Error("expected an error for a master smaller than the light frame")
+	}
+
+	c, err = NewCalibration(nil, planar.New(large.Rect, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Apply(planar.New(large.Rect, 3)); err == nil {
+		t.Error("expected an error for a master with a different number of channels")
+	}
+	if _, err := c.Apply(planar.New(large.Rect, 2)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDarkScale(t *testing.T) {
+	c := &Calibration{DarkMetadata: Metadata{ExposureTime: 60, Temperature: -10, HasTemperature: true}}
+
+	tests := []struct {
+		name     string
+		light    Metadata
+		expected float64
+	}{
+		{"same frame", Metadata{ExposureTime: 60, Temperature: -10, HasTemperature: true}, 1},
+		{"exposure ratio", Metadata{ExposureTime: 180, Temperature: -10, HasTemperature: true}, 3},
+		{"temperature doubling", Metadata{ExposureTime: 60, Temperature: -10 + darkDoublingTemperature, HasTemperature: true}, 2},
+		{"exposure and temperature", Metadata{ExposureTime: 30, Temperature: -10 - 2*darkDoublingTemperature, HasTemperature: true}, 0.125},
+		{"unknown exposure", Metadata{Temperature: -10, HasTemperature: true}, 1},
+		{"unknown temperature", Metadata{ExposureTime: 120, Temperature: 20}, 2},
+	}
+
+	for _, test := range tests {
+		if scale := c.DarkScale(test.light); math.Abs(scale-test.expected) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, scale)
+		}
+	}
+}
+
+func TestOptimizeDarkScale(t *testing.T) {
+	const k = 1.4
+	r := rand.New(rand.NewSource(1))
+
+	bounds := image.Rect(0, 0, 64, 64)
+	bias, dark, light := planar.New(bounds, 1), planar.New(bounds, 1), planar.New(bounds, 1)
+	for i := range dark.Channels[0] {
+		bias.Channels[0][i] = 0.05
+		// Hot pixels everywhere, so the wrong scale leaves a lot of pixel to pixel noise.
+		dark.Channels[0][i] = 0.05 + 0.2*r.Float32()
+		light.Channels[0][i] = 0.05 + k*(dark.Channels[0][i]-0.05) + 0.001*float32(r.NormFloat64())
+	}
+
+	c, err := NewCalibration(bias, dark, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale := c.OptimizeDarkScale(light, 1); math.Abs(scale-k) > 0.02 {
+		t.Errorf("expected a dark scale of %v, got %v", k, scale)
+	}
+
+	// A single column has no horizontal neighbours to compare.
+	column := image.Rect(0, 0, 1, 8)
+	c, err = NewCalibration(nil, planar.New(column, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale := c.OptimizeDarkScale(planar.New(column, 1), 0.7); scale != 0.7 {
+		t.Errorf("expected the initial scale for a single column, got %v", scale)
+	}
+}
@@ -6,11 +6,41 @@ import (
 	"math"
 	"sort"
 
+	"github.com/Coornail/starpack/planar"
 	colorful "github.com/lucasb-eyer/go-colorful"
 )
 
 type ColorMerge func([]colorful.Color) colorful.Color
 
+// LinearAverageColor is the mean of each channel.
+// Unlike AverageColor it keeps the values photometrically linear and does not shift hues.
+func LinearAverageColor(colors []colorful.Color) colorful.Color {
+	var r, g, b float64
+	for i := range colors {
+		r += colors[i].R
+		g += colors[i].G
+		b += colors[i].B
+	}
+
+	count := float64(len(colors))
+
+	return colorful.Color{R: r / count, G: g / count, B: b / count}
+}
+
+// LinearMedianColor is the median of each channel separately.
+func LinearMedianColor(colors []colorful.Color) colorful.Color {
+	r := make([]float64, len(colors))
+	g := make([]float64, len(colors))
+	b := make([]float64, len(colors))
+
+	for i := range colors {
+		r[i], g[i], b[i] = colors[i].R, colors[i].G, colors[i].B
+	}
+
+	return colorful.Color{R: median(r), G: median(g), B: median(b)}
+}
+
+// AverageColor averages in HCL space, a perceptual merge that wraps hues around.
 func AverageColor(colors []colorful.Color) colorful.Color {
 	var h, c, l float64
 	for i := range colors {
@@ -70,6 +100,7 @@ func ContrastColor(colors []colorful.Color) colorful.Color {
 	return colors[brightestColor]
 }
 
+// MedianColor is the median in Lab space, a perceptual merge ordered by lightness.
 func MedianColor(colors []colorful.Color) colorful.Color {
 	c := len(colors)
 	if c == 1 {
@@ -102,11 +133,31 @@ func rgbaToColorful(c color.Color) colorful.Color {
 	return res.Clamped()
 }
 
+// colorAt reads a pixel of a planar image without clamping, mono images are gray.
+func colorAt(img *planar.Image, i int) colorful.Color {
+	r, g, b := img.RGB(i)
+	return colorful.Color{R: float64(r), G: float64(g), B: float64(b)}
+}
+
+// setColor writes a pixel of a planar image, mono images take the red channel.
+func setColor(img *planar.Image, i int, c colorful.Color) {
+	img.Channels[0][i] = float32(c.R)
+	if len(img.Channels) >= 3 {
+		img.Channels[1][i] = float32(c.G)
+		img.Channels[2][i] = float32(c.B)
+	}
+}
+
+// pixelLuminance of a planar image at an index.
+func pixelLuminance(img *planar.Image, i int) float64 {
+	r, g, b := img.RGB(i)
+	return luminance([3]float64{float64(r), float64(g), float64(b)})
+}
+
 func distance(c1, c2 colorful.Color) float64 {
 	d := c1.DistanceCIEDE2000(c2)
 	if math.IsNaN(d) {
-		fmt.Printf("%s + %s = %#v\n", c1.Hex(), c2.Hex(), d)
-		panic("Color distance is NaN")
+		panic(fmt.Sprintf("Color distance of %s and %s is NaN", c1.Hex(), c2.Hex()))
 	}
 
 	if d < -1.0 {
@@ -0,0 +1,19 @@
+package starpack
+
+import (
+	"testing"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+func TestLinearMergeKeepsHue(t *testing.T) {
+	// Red and magenta: an HCL average wraps the hue, a linear one stays between them.
+	colors := []colorful.Color{{R: 1, G: 0, B: 0}, {R: 1, G: 0, B: 1}, {R: 1, G: 0, B: 0.5}}
+
+	if c := LinearAverageColor(colors); c.R != 1 || c.G != 0 || c.B != 0.5 {
+		t.Errorf("Unexpected average %v", c)
+	}
+	if c := LinearMedianColor(colors); c.R != 1 || c.G != 0 || c.B != 0.5 {
+		t.Errorf("Unexpected median %v", c)
+	}
+}
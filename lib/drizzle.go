@@ -0,0 +1,204 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+
+	"github.com/Coornail/starpack/debayer"
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+	"github.com/pkg/errors"
+)
+
+// drizzle accumulates input pixels ("drops") onto an output grid (Fruchter & Hook 2002).
+// Drops are axis aligned squares, the "turbo" kernel, so rotation and shear only move their centers and scale resizes them.
+type drizzle struct {
+	bounds  image.Rectangle
+	scale   float64
+	pixFrac float64
+	sums    [3][]float64
+	weights [3][]float64
+}
+
+func newDrizzle(inputBounds image.Rectangle, scale, pixFrac float64) *drizzle {
+	bounds := image.Rect(0, 0, int(float64(inputBounds.Dx())*scale), int(float64(inputBounds.Dy())*scale))
+	d := &drizzle{bounds: bounds, scale: scale, pixFrac: pixFrac}
+	for ch := range d.sums {
+		d.sums[ch] = make([]float64, bounds.Dx()*bounds.Dy())
+		d.weights[ch] = make([]float64, bounds.Dx()*bounds.Dy())
+	}
+
+	return d
+}
+
+// add drops the input pixel at x, y of a frame, transformed by config, into channel ch.
+func (d *drizzle) add(ch int, x, y int, inputBounds image.Rectangle, config starmap.OffsetConfig, v, w float64) {
+	// Star coordinates are at the pixel centers, the output grid starts at the pixel corners.
+	cx, cy := config.Project(float64(x), float64(y))
+	cx = (cx + 0.5 - float64(inputBounds.Min.X)) * d.scale
+	cy = (cy + 0.5 - float64(inputBounds.Min.Y)) * d.scale
+	half := d.pixFrac * d.scale * config.Scale() / 2
+
+	x0, x1 := cx-half, cx+half
+	y0, y1 := cy-half, cy+half
+	width := d.bounds.Dx()
+
+	for oy := max(int(math.Floor(y0)), 0); oy < min(int(math.Ceil(y1)), d.bounds.Dy()); oy++ {
+		overlapY := math.Min(y1, float64(oy+1)) - math.Max(y0, float64(oy))
+		if overlapY <= 0 {
+			continue
+		}
+		for ox := max(int(math.Floor(x0)), 0); ox < min(int(math.Ceil(x1)), width); ox++ {
+			overlapX := math.Min(x1, float64(ox+1)) - math.Max(x0, float64(ox))
+			if overlapX <= 0 {
+				continue
+			}
+
+			a := overlapX * overlapY * w
+			d.sums[ch][oy*width+ox] += a * v
+			d.weights[ch][oy*width+ox] += a
+		}
+	}
+}
+
+// value is the drizzled value of a channel, holes are filled from the neighbours.
+func (d *drizzle) value(ch, x, y int) float64 {
+	width := d.bounds.Dx()
+	if w := d.weights[ch][y*width+x]; w > 0 {
+		return d.sums[ch][y*width+x] / w
+	}
+
+	var sum, count float64
+	for j := -1; j <= 1; j++ {
+		for i := -1; i <= 1; i++ {
+			nx, ny := x+i, y+j
+			if nx < 0 || ny < 0 || nx >= width || ny >= d.bounds.Dy() {
+				continue
+			}
+			if w := d.weights[ch][ny*width+nx]; w > 0 {
+				sum += d.sums[ch][ny*width+nx] / w
+				count++
+			}
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / count
+}
+
+func (d *drizzle) image() *planar.Image {
+	output := planar.New(d.bounds, len(d.sums))
+	for ch := range output.Channels {
+		for y := 0; y < d.bounds.Dy(); y++ {
+			for x := 0; x < d.bounds.Dx(); x++ {
+				output.Channels[ch][output.Offset(x, y)] = float32(d.value(ch, x, y))
+			}
+		}
+	}
+
+	return output
+}
+
+// DrizzleOptions configures the output grid of Drizzle.
+type DrizzleOptions struct {
+	// Scale is the number of output pixels per input pixel along each axis.
+	Scale float64
+	// PixFrac shrinks the drops relative to the input pixel, between 0 and 1.
+	PixFrac float64
+}
+
+// Check returns an error for a scale or pixfrac that would leave the output empty.
+func (o DrizzleOptions) Check() error {
+	if o.Scale <= 0 {
+		return errors.Errorf("drizzle scale has to be positive, got %g", o.Scale)
+	}
+	if o.PixFrac <= 0 || o.PixFrac > 1 {
+		return errors.Errorf("drizzle pixfrac has to be above 0 and at most 1, got %g", o.PixFrac)
+	}
+
+	return nil
+}
+
+// Drizzle projects the pixels of the original frames onto a finer grid.
+// Unlike upscaling before stacking, the sub-pixel offsets between dithered frames recover real resolution.
+// Weights holds the weight of each frame, nil weighs them equally.
+// The second return value is the weight map: how much input fell on each output pixel, relative to the maximum.
+// Progress is reported as the "Drizzling" stage in frames, it can be nil.
+// It returns an error for options that do not pass Check.
+func Drizzle(ctx context.Context, frames []*planar.Image, offsets []starmap.OffsetConfig, weights []float64, options DrizzleOptions, progress Progress) (*planar.Image, *planar.Image, error) {
+	if err := options.Check(); err != nil {
+		return nil, nil, err
+	}
+
+	d := newDrizzle(frames[0].Bounds(), options.Scale, options.PixFrac)
+	drizzled := newCounter(progress, "Drizzling", len(frames))
+
+	for i := range frames {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		frameBounds := frames[i].Bounds()
+		for y := frameBounds.Min.Y; y < frameBounds.Max.Y; y++ {
+			for x := frameBounds.Min.X; x < frameBounds.Max.X; x++ {
+				r, g, b := frames[i].RGB(frames[i].Offset(x, y))
+				for ch, v := range [3]float32{r, g, b} {
+					d.add(ch, x, y, frameBounds, offsets[i], float64(v), weight(weights, i))
+				}
+			}
+		}
+		drizzled.add(1)
+	}
+
+	return d.image(), d.weightMap(), nil
+}
+
+func (d *drizzle) weightMap() *planar.Image {
+	output := planar.New(d.bounds, 1)
+
+	maxWeight := 0.0
+	for _, w := range d.weights[1] {
+		maxWeight = math.Max(maxWeight, w)
+	}
+	if maxWeight == 0 {
+		return output
+	}
+
+	for i, w := range d.weights[1] {
+		output.Channels[0][i] = float32(w / maxWeight)
+	}
+
+	return output
+}
+
+// BayerDrizzle integrates undebayered frames without interpolation.
+// Every sensor pixel is dropped into its own channel of the output at the position given by the frame's offset,
+// so with enough dithered frames every output pixel gets real samples of all three channels.
+// Weights holds the weight of each frame, nil weighs them equally.
+func BayerDrizzle(ctx context.Context, frames []*planar.Image, pattern debayer.Pattern, offsets []starmap.OffsetConfig, weights []float64, progress Progress) (*planar.Image, error) {
+	bounds := frames[0].Bounds()
+	d := newDrizzle(bounds, 1, 1)
+	drizzled := newCounter(progress, "Drizzling", len(frames))
+
+	for i := range frames {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		frameBounds := frames[i].Bounds()
+		for y := frameBounds.Min.Y; y < frameBounds.Max.Y; y++ {
+			for x := frameBounds.Min.X; x < frameBounds.Max.X; x++ {
+				v := frames[i].Channels[0][frames[i].Offset(x, y)]
+				ch := pattern.Color(x-frameBounds.Min.X, y-frameBounds.Min.Y)
+				d.add(ch, x, y, frameBounds, offsets[i], float64(v), weight(weights, i))
+			}
+		}
+		drizzled.add(1)
+	}
+
+	return d.image(), nil
+}
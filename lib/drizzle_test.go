@@ -0,0 +1,108 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/debayer"
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+)
+
+func TestBayerDrizzleKeepsChannelsApart(t *testing.T) {
+	bounds := image.Rect(0, 0, 6, 4)
+	levels := [3]float32{0.1, 0.5, 0.9}
+	frame := planar.New(bounds, 1)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			frame.Channels[0][frame.Offset(x, y)] = levels[debayer.RGGB.Color(x, y)]
+		}
+	}
+
+	// The second frame is dithered by a pixel, so its red samples land where the first one has green.
+	offsets := []starmap.OffsetConfig{{}, {Matrix: starmap.Translation(1, 0)}}
+	output, err := BayerDrizzle(context.Background(), []*planar.Image{frame, frame}, debayer.RGGB, offsets, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ch, level := range levels {
+		for i, v := range output.Channels[ch] {
+			if v != level {
+				t.Fatalf("channel %d at %d,%d is %f, expected only its own samples %f", ch, i%bounds.Dx(), i/bounds.Dx(), v, level)
+			}
+		}
+	}
+}
+
+func TestDrizzleConservesFlux(t *testing.T) {
+	bounds := image.Rect(0, 0, 6, 6)
+	frame := planar.New(bounds, 1)
+	frame.Channels[0][frame.Offset(2, 2)] = 1
+
+	// The second frame is dithered by half a pixel, a whole output pixel at scale 2.
+	offsets := []starmap.OffsetConfig{{}, {Matrix: starmap.Translation(0.5, 0)}}
+	output, weights, err := Drizzle(context.Background(), []*planar.Image{frame, frame}, offsets, nil, DrizzleOptions{Scale: 2, PixFrac: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flux float64
+	for _, v := range output.Channels[0] {
+		flux += float64(v)
+	}
+	if math.Abs(flux/4-1) > 1e-6 {
+		t.Errorf("expected a flux of 1 input pixel, got %f", flux/4)
+	}
+	// Both frames cover the star's middle column, one each the columns beside it.
+	for x, expected := range map[int]float32{4: 0.5, 5: 1, 6: 0.5} {
+		if v := output.Channels[0][output.Offset(x, 4)]; v != expected {
+			t.Errorf("expected %f at %d,4, got %f", expected, x, v)
+		}
+	}
+
+	// Only the first frame reaches the left column, the dithered one is clipped on the right.
+	for y := 0; y < weights.Bounds().Dy(); y++ {
+		for x := 0; x < weights.Bounds().Dx(); x++ {
+			expected := float32(1)
+			if x == 0 {
+				expected = 0.5
+			}
+			if w := weights.Channels[0][weights.Offset(x, y)]; w != expected {
+				t.Fatalf("expected a weight of %f at %d,%d, got %f", expected, x, y, w)
+			}
+		}
+	}
+}
+
+func TestDrizzleOptions(t *testing.T) {
+	frames := []*planar.Image{planar.New(image.Rect(0, 0, 4, 4), 1)}
+	offsets := []starmap.OffsetConfig{{}}
+
+	for _, options := range []DrizzleOptions{{Scale: 2, PixFrac: 0}, {Scale: 2, PixFrac: 1.5}, {Scale: 0, PixFrac: 0.7}, {Scale: -1, PixFrac: 0.7}} {
+		if _, _, err := Drizzle(context.Background(), frames, offsets, nil, options, nil); err == nil {
+			t.Errorf("expected an error for %+v", options)
+		}
+	}
+}
+
+func TestDrizzleWeighsFrames(t *testing.T) {
+	bounds := image.Rect(0, 0, 4, 4)
+	bright, faint := planar.New(bounds, 1), planar.New(bounds, 1)
+	for i := range bright.Channels[0] {
+		bright.Channels[0][i] = 0.8
+		faint.Channels[0][i] = 0.4
+	}
+
+	output, _, err := Drizzle(context.Background(), []*planar.Image{bright, faint}, make([]starmap.OffsetConfig, 2), []float64{1, 3}, DrizzleOptions{Scale: 1, PixFrac: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range output.Channels[0] {
+		if math.Abs(float64(v)-0.5) > 1e-6 {
+			t.Fatalf("expected the weighted mean 0.5 at %d, got %f", i, v)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package starpack
+
+import (
+	"fmt"
+
+	"github.com/Coornail/starpack/fits"
+	"github.com/Coornail/starpack/starmap"
+)
+
+// History describes how a stack was made.
+// It ends up in the header of FITS and XISF outputs so other tools can show it.
+type History struct {
+	MergeMethod string
+	Frames      int
+	// Offsets of each frame relative to the reference frame.
+	Offsets []starmap.OffsetConfig
+	// Command line flags in -name=value form.
+	Flags []string
+	// Acquisition information of the stacked frames.
+	Metadata Metadata
+}
+
+func (h History) Header() fits.Header {
+	var header fits.Header
+	header.SetString("CREATOR", "starpack", "")
+
+	if h.Frames > 0 {
+		header.Set("NCOMBINE", fmt.Sprintf("%d", h.Frames), "number of stacked frames")
+	}
+	if h.Metadata.ExposureTime > 0 {
+		header.Set("EXPTIME", fmt.Sprintf("%g", h.Metadata.ExposureTime), "[s] exposure time")
+	}
+	if h.Metadata.HasTemperature {
+		header.Set("CCD-TEMP", fmt.Sprintf("%g", h.Metadata.Temperature), "[C] sensor temperature")
+	}
+	if h.MergeMethod != "" {
+		header.SetString("STACKMTH", h.MergeMethod, "pixel merge method")
+		header.AddHistory("starpack merge method: " + h.MergeMethod)
+	}
+	for i, o := range h.Offsets {
+		header.AddHistory(fmt.Sprintf("frame %d offset %s", i, o))
+		header.AddHistory(fmt.Sprintf("frame %d matrix %.6g", i, o.Transformation()))
+	}
+	for _, f := range h.Flags {
+		header.AddHistory("starpack " + f)
+	}
+
+	return header
+}
@@ -0,0 +1,24 @@
+package starpack
+
+import (
+	"testing"
+
+	"github.com/Coornail/starpack/starmap"
+)
+
+func TestHistoryReferenceMatrix(t *testing.T) {
+	h := History{Offsets: []starmap.OffsetConfig{{}, {Matrix: starmap.Translation(1, 2)}}}
+
+	var matrices []string
+	for _, c := range h.Header().Cards {
+		if c.Key == "HISTORY" {
+			matrices = append(matrices, c.Value)
+		}
+	}
+
+	// The reference frame is not transformed, its zero config is the identity.
+	expected := "frame 0 matrix [1 0 0 0 1 0 0 0 1]"
+	if len(matrices) != 4 || matrices[1] != expected {
+		t.Errorf("expected %q, got %q", expected, matrices)
+	}
+}
@@ -3,6 +3,7 @@ package starpack
 import (
 	"image"
 
+	"github.com/Coornail/starpack/planar"
 	"github.com/disintegration/imaging"
 )
 
@@ -10,11 +11,14 @@ const downSamplePoints = 3
 
 // EstimateLightPollutionMask generates a mask to remove it from the image.
 // Based on the idea from https://benedikt-bitterli.me/astro/ .
-func EstimateLightPollutionMask(img image.Image) image.Image {
+func EstimateLightPollutionMask(img image.Image) *planar.Image {
 	downsampled := imaging.Resize(img, downSamplePoints, downSamplePoints, imaging.Lanczos)
 	// @todo improve on upscaling.
 	upsampled := imaging.Resize(downsampled, img.Bounds().Max.X, img.Bounds().Max.Y, imaging.MitchellNetravali)
 	upsampled = imaging.Blur(upsampled, 1.5)
 
-	return upsampled
+	mask := planar.FromImage(upsampled)
+	mask.Rect = img.Bounds()
+
+	return mask
 }
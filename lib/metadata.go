@@ -0,0 +1,83 @@
+package starpack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Coornail/starpack/fits"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata is the acquisition information of a frame, read from FITS headers or EXIF.
+type Metadata struct {
+	// ExposureTime in seconds, 0 if unknown.
+	ExposureTime float64
+	// Temperature of the sensor in Celsius, only valid if HasTemperature is set.
+	Temperature    float64
+	HasTemperature bool
+	// BayerPattern of undebayered color sensor data, empty for mono or RGB images.
+	BayerPattern string
+}
+
+// ReadMetadata reads the acquisition information of an image file.
+// Missing information is left at its zero value.
+func ReadMetadata(filename string) Metadata {
+	var m Metadata
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fits", ".fit", ".fts":
+		h, err := fits.ReadHeader(f)
+		if err != nil {
+			return m
+		}
+		m.ExposureTime, _ = h.ExposureTime()
+		m.Temperature, m.HasTemperature = h.Temperature()
+		m.BayerPattern, _ = h.BayerPattern()
+	default:
+		x, err := exif.Decode(f)
+		if err != nil {
+			return m
+		}
+		if tag, err := x.Get(exif.ExposureTime); err == nil {
+			if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+				m.ExposureTime = float64(num) / float64(den)
+			}
+		}
+	}
+
+	return m
+}
+
+// AverageMetadata combines the metadata of the frames that went into a master frame.
+func AverageMetadata(metadata []Metadata) Metadata {
+	var m Metadata
+	var exposures, temperatures int
+
+	for i := range metadata {
+		if metadata[i].ExposureTime > 0 {
+			m.ExposureTime += metadata[i].ExposureTime
+			exposures++
+		}
+		if metadata[i].HasTemperature {
+			m.Temperature += metadata[i].Temperature
+			temperatures++
+		}
+	}
+
+	if exposures > 0 {
+		m.ExposureTime /= float64(exposures)
+	}
+	if temperatures > 0 {
+		m.Temperature /= float64(temperatures)
+		m.HasTemperature = true
+	}
+
+	return m
+}
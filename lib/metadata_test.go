@@ -0,0 +1,44 @@
+package starpack
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Coornail/starpack/fits"
+)
+
+func TestReadMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var h fits.Header
+	h.Set("EXPTIME", "120.5", "")
+	h.Set("CCD-TEMP", "-15", "")
+	h.SetString("BAYERPAT", "RGGB", "")
+
+	// An odd number of rows keeps the bayer pattern of the bottom-up file.
+	file := filepath.Join(dir, "light.fits")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fits.Encode(f, image.NewGray16(image.Rect(0, 0, 4, 3)), h); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	expected := Metadata{ExposureTime: 120.5, Temperature: -15, HasTemperature: true, BayerPattern: "RGGB"}
+	if m := ReadMetadata(file); m != expected {
+		t.Errorf("expected %+v, got %+v", expected, m)
+	}
+
+	if m := ReadMetadata(filepath.Join(dir, "missing.fits")); m != (Metadata{}) {
+		t.Errorf("expected no metadata for a missing file, got %+v", m)
+	}
+}
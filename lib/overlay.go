@@ -0,0 +1,71 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+	"github.com/pkg/errors"
+)
+
+// Strength of the asinh stretch of overlay backgrounds, higher brings out fainter detail.
+const overlayStretch = 200
+
+// Overlay draws the stars of the frame, and the residuals of their pairs with the reference, over the stretched frame.
+// See starmap.Starmap.Overlay.
+func Overlay(img *planar.Image, sm starmap.Starmap, pairs []starmap.Pair, config starmap.OffsetConfig) image.Image {
+	return sm.Overlay(stretch(img), pairs, config)
+}
+
+// WriteOverlay detects the stars of the frame at sigma, pairs them with the reference through the transformation
+// and saves their overlay as a png.
+func WriteOverlay(fileName string, img *planar.Image, referenceMap starmap.Starmap, sigma float64, config starmap.OffsetConfig) error {
+	sm, _ := DetectStars(img, sigma)
+	pairs := referenceMap.Pairs(sm, config, refineDistance)
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "saving %s", fileName)
+	}
+	defer f.Close()
+
+	return errors.Wrapf(png.Encode(f, Overlay(img, sm, pairs, config)), "saving %s", fileName)
+}
+
+// stretch is the luminance of the frame with the local background removed, on an asinh curve from
+// two sigmas of the noise below the background, so that faint stars show up on a dark sky.
+func stretch(img *planar.Image) *image.Gray {
+	bounds := img.Bounds()
+	values := brightnessMap(img)
+	mesh := newBackgroundMesh(values, bounds)
+
+	parallelRows(context.Background(), bounds, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+				values[i] -= mesh.Background(x, y) - 2*mesh.Noise(x, y)
+			}
+		}
+	})
+
+	var white float64
+	for _, v := range values {
+		white = math.Max(white, v)
+	}
+
+	output := image.NewGray(bounds)
+	if white <= 0 {
+		return output
+	}
+	for i, v := range values {
+		t := math.Asinh(math.Max(v, 0)/white*overlayStretch) / math.Asinh(overlayStretch)
+		output.SetGray(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx(), color.Gray{Y: uint8(math.Round(255 * t))})
+	}
+
+	return output
+}
@@ -0,0 +1,85 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// Threads is the number of workers that process an image.
+var Threads = runtime.GOMAXPROCS(0)
+
+// Bands per worker, more bands even out the work when some rows are slower than others.
+const bandsPerThread = 4
+
+// parallelRows splits the rows of bounds into bands and calls fn for each band on Threads workers.
+// fn gets the rows from minY up to maxY, and has to be safe to call concurrently for different bands.
+// No new bands are started once ctx is done, the bands that are running are finished.
+func parallelRows(ctx context.Context, bounds image.Rectangle, fn func(minY, maxY int)) error {
+	threads := max(Threads, 1)
+	rows := bounds.Dy()
+	bandHeight := max(rows/(threads*bandsPerThread), 1)
+
+	bands := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(threads, rows); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for minY := range bands {
+				fn(minY, min(minY+bandHeight, bounds.Max.Y))
+			}
+		}()
+	}
+
+	var err error
+	for minY := bounds.Min.Y; minY < bounds.Max.Y && err == nil; minY += bandHeight {
+		select {
+		case bands <- minY:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	close(bands)
+	wg.Wait()
+
+	return err
+}
+
+// ParallelFrames calls fn for every frame index from first up to last on Threads workers.
+// fn has to be safe to call concurrently for different frames.
+// No new frames are started once ctx is done, the frames that are running are finished and ctx.Err() is returned.
+func ParallelFrames(ctx context.Context, first, last int, fn func(i int)) error {
+	frames := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(Threads, 1), last-first); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range frames {
+				// A frame can be handed over just as ctx is done.
+				if ctx.Err() == nil {
+					fn(i)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i := first; i < last && err == nil; i++ {
+		select {
+		case frames <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	close(frames)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,157 @@
+package starpack
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+func TestParallelRowsCoversEveryRow(t *testing.T) {
+	defer func(threads int) { Threads = threads }(Threads)
+
+	bounds := image.Rect(3, -2, 10, 37)
+	for _, Threads = range []int{0, 1, 3, 64} {
+		var mu sync.Mutex
+		seen := make(map[int]int)
+		parallelRows(context.Background(), bounds, func(minY, maxY int) {
+			mu.Lock()
+			defer mu.Unlock()
+			for y := minY; y < maxY; y++ {
+				seen[y]++
+			}
+		})
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			if seen[y] != 1 {
+				t.Fatalf("%d threads: row %d processed %d times", Threads, y, seen[y])
+			}
+		}
+		if len(seen) != bounds.Dy() {
+			t.Fatalf("%d threads: processed %d rows, expected %d", Threads, len(seen), bounds.Dy())
+		}
+	}
+}
+
+type recordedProgress struct {
+	mu     sync.Mutex
+	stages map[string]int
+}
+
+func (p *recordedProgress) Progress(stage string, done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done > p.stages[stage] {
+		p.stages[stage] = done
+	}
+}
+
+func TestStarpackProgressAndCancel(t *testing.T) {
+	frames := noiseFrames(3, 16, 10)
+
+	progress := &recordedProgress{stages: make(map[string]int)}
+	if _, err := Starpack(context.Background(), frames, LinearAverageColor, progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.stages["Merging"] != 10 {
+		t.Errorf("expected all 10 rows merged, got %v", progress.stages)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Starpack(ctx, frames, LinearAverageColor, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func noiseFrames(count, width, height int) []*planar.Image {
+	r := rand.New(rand.NewSource(1))
+	frames := make([]*planar.Image, count)
+	for f := range frames {
+		frames[f] = planar.New(image.Rect(0, 0, width, height), 3)
+		for ch := range frames[f].Channels {
+			for i := range frames[f].Channels[ch] {
+				frames[f].Channels[ch][i] = 0.1 + 0.02*float32(r.NormFloat64())
+			}
+		}
+	}
+
+	return frames
+}
+
+// benchmarkThreads runs fn with a single worker and with one per CPU.
+func benchmarkThreads(b *testing.B, fn func()) {
+	defer func(threads int) { Threads = threads }(Threads)
+
+	counts := []int{1}
+	if runtime.GOMAXPROCS(0) > 1 {
+		counts = append(counts, runtime.GOMAXPROCS(0))
+	}
+
+	for _, threads := range counts {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			Threads = threads
+			for i := 0; i < b.N; i++ {
+				fn()
+			}
+		})
+	}
+}
+
+func BenchmarkStarpack(b *testing.B) {
+	frames := noiseFrames(8, 256, 256)
+	benchmarkThreads(b, func() { Starpack(context.Background(), frames, LinearAverageColor, nil) })
+}
+
+// goroutinePerPixelStarpack is the merge Starpack replaced: a goroutine for every pixel, waiting for each row.
+// It is only kept as the baseline of BenchmarkStarpack.
+func goroutinePerPixelStarpack(images []*planar.Image, colorMergeMethod ColorMerge) *planar.Image {
+	bounds := images[0].Bounds()
+	output := planar.New(bounds, len(images[0].Channels))
+
+	var wg sync.WaitGroup
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				currentColor := make([]colorful.Color, len(images))
+				for f := range images {
+					currentColor[f] = colorAt(images[f], i)
+				}
+				setColor(output, i, colorMergeMethod(currentColor))
+			}(output.Offset(x, y))
+		}
+		wg.Wait()
+	}
+
+	return output
+}
+
+func BenchmarkStarpackGoroutinePerPixel(b *testing.B) {
+	frames := noiseFrames(8, 256, 256)
+	for i := 0; i < b.N; i++ {
+		goroutinePerPixelStarpack(frames, LinearAverageColor)
+	}
+}
+
+func BenchmarkDenoiseImage(b *testing.B) {
+	frame := noiseFrames(1, 256, 256)[0]
+	benchmarkThreads(b, func() { DenoiseImage(context.Background(), frame, nil) })
+}
+
+func BenchmarkTranslate(b *testing.B) {
+	frame := noiseFrames(1, 1024, 1024)[0]
+	benchmarkThreads(b, func() { Translate(frame, 3, -2) })
+}
+
+func BenchmarkGetStarmap(b *testing.B) {
+	frame := noiseFrames(1, 512, 512)[0]
+	benchmarkThreads(b, func() { GetStarmap(frame, 0) })
+}
@@ -0,0 +1,33 @@
+package starpack
+
+import (
+	"sync/atomic"
+)
+
+// Progress is told how far a long-running stage got.
+// It can be called from several goroutines at once.
+type Progress interface {
+	Progress(stage string, done, total int)
+}
+
+// counter reports the progress of a stage that is worked on concurrently.
+type counter struct {
+	progress Progress
+	stage    string
+	total    int
+	done     int64
+}
+
+func newCounter(progress Progress, stage string, total int) *counter {
+	return &counter{progress: progress, stage: stage, total: total}
+}
+
+// add counts n more units of work as done, a nil counter or progress ignores it.
+func (c *counter) add(n int) {
+	if c == nil || c.progress == nil {
+		return
+	}
+
+	done := atomic.AddInt64(&c.done, int64(n))
+	c.progress.Progress(c.stage, int(done), c.total)
+}
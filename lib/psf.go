@@ -0,0 +1,252 @@
+package starpack
+
+import (
+	"math"
+
+	"github.com/Coornail/starpack/starmap"
+	"github.com/pkg/errors"
+)
+
+// Models fitted to the detected stars.
+const (
+	// PSFNone keeps the intensity weighted moments.
+	PSFNone     = "none"
+	PSFGaussian = "gaussian"
+	// PSFMoffat has wider wings than a gaussian, closer to stars seen through the atmosphere.
+	PSFMoffat = "moffat"
+)
+
+// PSF is the model fitted to every detected star.
+var PSF = PSFNone
+
+// CheckPSF returns an error if the model is not one of the PSF constants.
+func CheckPSF(model string) error {
+	switch model {
+	case PSFNone, PSFGaussian, PSFMoffat:
+		return nil
+	}
+
+	return errors.Errorf("unknown psf: %q", model)
+}
+
+const (
+	psfIterations = 50
+	// Initial Moffat beta, typical of seeing limited stars.
+	moffatBeta = 2.5
+	// Largest distance in pixels a fit may move the centroid.
+	maxPSFShift = 2.0
+)
+
+// psfSample is a background subtracted pixel around a star.
+type psfSample struct {
+	x, y, v float64
+}
+
+// psfModel is an elliptical profile. The first parameters are shared by every model:
+// amplitude, center x and y, the a, b, c of the quadratic form a*dx^2 + 2b*dx*dy + c*dy^2, and a residual background.
+type psfModel func(p []float64, x, y float64) float64
+
+const (
+	psfAmplitude = iota
+	psfX
+	psfY
+	psfA
+	psfB
+	psfC
+	psfBackground
+	// Only used by the Moffat profile.
+	psfBeta
+)
+
+func quadratic(p []float64, x, y float64) float64 {
+	dx, dy := x-p[psfX], y-p[psfY]
+
+	return p[psfA]*dx*dx + 2*p[psfB]*dx*dy + p[psfC]*dy*dy
+}
+
+func gaussianPSF(p []float64, x, y float64) float64 {
+	return p[psfBackground] + p[psfAmplitude]*math.Exp(-quadratic(p, x, y))
+}
+
+func moffatPSF(p []float64, x, y float64) float64 {
+	return p[psfBackground] + p[psfAmplitude]*math.Pow(1+quadratic(p, x, y), -p[psfBeta])
+}
+
+// fitPSF fits the model to the samples with Levenberg-Marquardt, starting from the star measured by moments.
+// It returns false if the fit does not converge to a plausible star.
+func fitPSF(model string, samples []psfSample, s starmap.Star, radius float64) (starmap.Star, bool) {
+	if s.FWHM <= 0 || len(samples) < 9 {
+		return s, false
+	}
+
+	var f psfModel
+	var p []float64
+	switch model {
+	case PSFGaussian:
+		sigma := s.FWHM / sigmaToFWHM
+		q := 1 / (2 * sigma * sigma)
+		f, p = gaussianPSF, []float64{s.Peak, s.X, s.Y, q, 0, q, 0}
+	case PSFMoffat:
+		alpha := s.FWHM / (2 * math.Sqrt(math.Pow(2, 1/moffatBeta)-1))
+		q := 1 / (alpha * alpha)
+		f, p = moffatPSF, []float64{s.Peak, s.X, s.Y, q, 0, q, 0, moffatBeta}
+	default:
+		return s, false
+	}
+
+	p = levenbergMarquardt(f, samples, p)
+
+	det := p[psfA]*p[psfC] - p[psfB]*p[psfB]
+	if p[psfAmplitude] <= 0 || p[psfA] <= 0 || det <= 0 ||
+		math.Hypot(p[psfX]-s.X, p[psfY]-s.Y) > maxPSFShift || model == PSFMoffat && p[psfBeta] <= 1 {
+		return s, false
+	}
+
+	// Eigenvalues of the quadratic form, the larger one belongs to the minor axis.
+	d := math.Sqrt((p[psfA]-p[psfC])*(p[psfA]-p[psfC])/4 + p[psfB]*p[psfB])
+	large := (p[psfA]+p[psfC])/2 + d
+	small := (p[psfA]+p[psfC])/2 - d
+
+	fitted := s
+	fitted.X, fitted.Y = p[psfX], p[psfY]
+	fitted.Peak = p[psfAmplitude]
+	fitted.Eccentricity = math.Sqrt(1 - small/large)
+
+	var majorFWHM, minorFWHM float64
+	if model == PSFGaussian {
+		majorFWHM = sigmaToFWHM / math.Sqrt(2*small)
+		minorFWHM = sigmaToFWHM / math.Sqrt(2*large)
+		fitted.Flux = p[psfAmplitude] * math.Pi / math.Sqrt(det)
+	} else {
+		width := 2 * math.Sqrt(math.Pow(2, 1/p[psfBeta])-1)
+		majorFWHM = width / math.Sqrt(small)
+		minorFWHM = width / math.Sqrt(large)
+		fitted.Flux = p[psfAmplitude] * math.Pi / ((p[psfBeta] - 1) * math.Sqrt(det))
+	}
+	fitted.FWHM = math.Sqrt((majorFWHM*majorFWHM + minorFWHM*minorFWHM) / 2)
+	if fitted.FWHM > 2*radius {
+		return s, false
+	}
+
+	return fitted, true
+}
+
+// levenbergMarquardt minimizes the squared difference of the model and the samples, from the initial parameters.
+// The Jacobian is estimated with finite differences.
+func levenbergMarquardt(f psfModel, samples []psfSample, p []float64) []float64 {
+	cost := func(p []float64) float64 {
+		var sum float64
+		for _, s := range samples {
+			r := f(p, s.x, s.y) - s.v
+			sum += r * r
+		}
+		return sum
+	}
+
+	k := len(p)
+	jacobian := make([][]float64, len(samples))
+	for i := range jacobian {
+		jacobian[i] = make([]float64, k)
+	}
+	shifted := make([]float64, k)
+	candidate := make([]float64, k)
+
+	lambda := 1e-3
+	current := cost(p)
+	for iteration := 0; iteration < psfIterations; iteration++ {
+		residuals := make([]float64, len(samples))
+		for i, s := range samples {
+			residuals[i] = s.v - f(p, s.x, s.y)
+		}
+		for j := range p {
+			copy(shifted, p)
+			h := 1e-6 * math.Max(math.Abs(p[j]), 1e-3)
+			shifted[j] += h
+			for i, s := range samples {
+				jacobian[i][j] = (f(shifted, s.x, s.y) - (s.v - residuals[i])) / h
+			}
+		}
+
+		jtj := make([][]float64, k)
+		jtr := make([]float64, k)
+		for a := range jtj {
+			jtj[a] = make([]float64, k)
+			for i := range samples {
+				jtr[a] += jacobian[i][a] * residuals[i]
+				for b := range jtj[a] {
+					jtj[a][b] += jacobian[i][a] * jacobian[i][b]
+				}
+			}
+		}
+
+		improved := false
+		for lambda < 1e10 {
+			damped := make([][]float64, k)
+			for a := range damped {
+				damped[a] = make([]float64, k)
+				copy(damped[a], jtj[a])
+				damped[a][a] += lambda * math.Max(jtj[a][a], 1e-12)
+			}
+
+			step, ok := solveLinear(damped, jtr)
+			if ok {
+				for j := range p {
+					candidate[j] = p[j] + step[j]
+				}
+				if next := cost(candidate); next < current && !math.IsNaN(next) {
+					converged := current-next < 1e-10*current
+					copy(p, candidate)
+					current = next
+					lambda = math.Max(lambda/10, 1e-12)
+					improved = !converged
+					break
+				}
+			}
+			lambda *= 10
+		}
+
+		if !improved {
+			break
+		}
+	}
+
+	return p
+}
+
+// solveLinear solves a * x = b with Gaussian elimination and partial pivoting, a is modified.
+func solveLinear(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	b = append([]float64(nil), b...)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-300 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for r := col + 1; r < n; r++ {
+			factor := a[r][col] / a[col][col]
+			for c := col; c < n; c++ {
+				a[r][c] -= factor * a[col][c]
+			}
+			b[r] -= factor * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		sum := b[r]
+		for c := r + 1; c < n; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+
+	return x, true
+}
@@ -0,0 +1,372 @@
+package starpack
+
+import (
+	"math"
+	"sort"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+// Winsorization keeps values within this many sigmas of the median while estimating sigma.
+const (
+	winsorizationLimit      = 1.5
+	winsorizationCorrection = 1.134
+	winsorizationSteps      = 10
+)
+
+// Rejection counts the frames that were left out of a pixel below and above the accepted range.
+// With per-channel clipping it is the highest count of any channel.
+type Rejection struct {
+	Low  int
+	High int
+}
+
+// RejectionMerge is a ColorMerge that also reports what it rejected.
+// Weights holds the weight of each frame, nil weighs them equally.
+type RejectionMerge func(colors []colorful.Color, weights []float64) (colorful.Color, Rejection)
+
+// ColorMerge drops the rejection counts.
+func (m RejectionMerge) ColorMerge() ColorMerge {
+	return func(colors []colorful.Color) colorful.Color {
+		c, _ := m(colors, nil)
+		return c
+	}
+}
+
+// NoRejection turns a ColorMerge into a RejectionMerge that never rejects anything and ignores the weights.
+func NoRejection(m ColorMerge) RejectionMerge {
+	return func(colors []colorful.Color, weights []float64) (colorful.Color, Rejection) {
+		return m(colors), Rejection{}
+	}
+}
+
+// WeightedAverageColor is the weighted mean of each channel.
+func WeightedAverageColor(colors []colorful.Color, weights []float64) (colorful.Color, Rejection) {
+	var r, g, b, total float64
+	for i := range colors {
+		w := weight(weights, i)
+		r += colors[i].R * w
+		g += colors[i].G * w
+		b += colors[i].B * w
+		total += w
+	}
+
+	if total == 0 {
+		return colorful.Color{}, Rejection{}
+	}
+
+	return colorful.Color{R: r / total, G: g / total, B: b / total}, Rejection{}
+}
+
+// WeightedMedianColor is the weighted median of each channel: the value with half of the total weight on either side.
+func WeightedMedianColor(colors []colorful.Color, weights []float64) (colorful.Color, Rejection) {
+	var result [3]float64
+	values := make([]float64, len(colors))
+	order := make([]int, len(colors))
+	for ch := range result {
+		for i := range colors {
+			values[i] = [3]float64{colors[i].R, colors[i].G, colors[i].B}[ch]
+			order[i] = i
+		}
+		result[ch] = weightedMedian(values, weights, order)
+	}
+
+	return colorful.Color{R: result[0], G: result[1], B: result[2]}, Rejection{}
+}
+
+// weightedMedian reorders order by value. When the weight below a value is exactly half, it averages it with the next one,
+// so equal weights give the same result as median.
+func weightedMedian(values, weights []float64, order []int) float64 {
+	sort.Slice(order, func(a, b int) bool {
+		return values[order[a]] < values[order[b]]
+	})
+
+	var total float64
+	for i := range values {
+		total += weight(weights, i)
+	}
+	if total <= 0 {
+		return 0
+	}
+
+	var cumulative float64
+	for k, i := range order {
+		cumulative += weight(weights, i)
+		if cumulative == total/2 && k+1 < len(order) {
+			return (values[i] + values[order[k+1]]) / 2
+		}
+		if cumulative > total/2 {
+			return values[i]
+		}
+	}
+
+	return values[order[len(order)-1]]
+}
+
+func weight(weights []float64, i int) float64 {
+	if weights == nil {
+		return 1
+	}
+
+	return weights[i]
+}
+
+// ClipOptions configures the rejection merges.
+type ClipOptions struct {
+	// Low and High are the accepted distance below and above the center in sigmas,
+	// or as a fraction of the median for percentile clipping.
+	Low  float64
+	High float64
+	// Iterations is the maximum number of clipping passes.
+	Iterations int
+}
+
+// clipFunc returns which values to keep.
+type clipFunc func(values []float64, keep []bool, options ClipOptions)
+
+// SigmaClipColor averages the values after iteratively rejecting the ones too far from the median (kappa-sigma clipping).
+func SigmaClipColor(options ClipOptions) RejectionMerge {
+	return clipMerge(sigmaClip, options)
+}
+
+// WinsorizedSigmaClipColor is sigma clipping with a sigma estimated from winsorized values,
+// which is robust against the outliers it is about to reject.
+func WinsorizedSigmaClipColor(options ClipOptions) RejectionMerge {
+	return clipMerge(winsorizedSigmaClip, options)
+}
+
+// PercentileClipColor rejects the values that differ from the median by more than a fraction of it.
+// It is meant for small stacks where sigma is meaningless.
+func PercentileClipColor(options ClipOptions) RejectionMerge {
+	return clipMerge(percentileClip, options)
+}
+
+// LinearFitClipColor fits a line to the sorted values and rejects the ones far from it.
+// It copes with stacks where the sky background changes between frames.
+func LinearFitClipColor(options ClipOptions) RejectionMerge {
+	return clipMerge(linearFitClip, options)
+}
+
+// clipMerge clips each channel separately and takes the weighted average of what is left.
+func clipMerge(clip clipFunc, options ClipOptions) RejectionMerge {
+	return func(colors []colorful.Color, weights []float64) (colorful.Color, Rejection) {
+		values := make([]float64, len(colors))
+		keep := make([]bool, len(colors))
+
+		var result [3]float64
+		var rejection Rejection
+		for ch := range result {
+			for i := range colors {
+				values[i] = [3]float64{colors[i].R, colors[i].G, colors[i].B}[ch]
+				keep[i] = true
+			}
+
+			if len(values) > 2 {
+				clip(values, keep, options)
+			}
+
+			center := median(values)
+			var sum, total float64
+			var low, high int
+			for i := range values {
+				switch {
+				case keep[i]:
+					sum += values[i] * weight(weights, i)
+					total += weight(weights, i)
+				case values[i] < center:
+					low++
+				default:
+					high++
+				}
+			}
+
+			if total == 0 {
+				result[ch] = center
+			} else {
+				result[ch] = sum / total
+			}
+
+			rejection.Low = max(rejection.Low, low)
+			rejection.High = max(rejection.High, high)
+		}
+
+		return colorful.Color{R: result[0], G: result[1], B: result[2]}, rejection
+	}
+}
+
+func sigmaClip(values []float64, keep []bool, options ClipOptions) {
+	for iteration := 0; iteration < options.Iterations; iteration++ {
+		kept := keptValues(values, keep)
+		center := median(kept)
+		sigma := stdDev(kept)
+
+		if !rejectOutside(values, keep, center, center-options.Low*sigma, center+options.High*sigma) {
+			return
+		}
+	}
+}
+
+func winsorizedSigmaClip(values []float64, keep []bool, options ClipOptions) {
+	for iteration := 0; iteration < options.Iterations; iteration++ {
+		kept := keptValues(values, keep)
+		center := median(kept)
+		sigma := stdDev(kept)
+
+		winsorized := make([]float64, len(kept))
+		for step := 0; step < winsorizationSteps; step++ {
+			lo, hi := center-winsorizationLimit*sigma, center+winsorizationLimit*sigma
+			for i := range kept {
+				winsorized[i] = math.Min(math.Max(kept[i], lo), hi)
+			}
+
+			previous := sigma
+			sigma = winsorizationCorrection * stdDev(winsorized)
+			if math.Abs(sigma-previous) <= previous*0.0005 {
+				break
+			}
+		}
+
+		if !rejectOutside(values, keep, center, center-options.Low*sigma, center+options.High*sigma) {
+			return
+		}
+	}
+}
+
+func percentileClip(values []float64, keep []bool, options ClipOptions) {
+	center := median(values)
+	spread := math.Abs(center)
+	rejectOutside(values, keep, center, center-spread*options.Low, center+spread*options.High)
+}
+
+func linearFitClip(values []float64, keep []bool, options ClipOptions) {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return values[order[i]] < values[order[j]]
+	})
+
+	for iteration := 0; iteration < options.Iterations; iteration++ {
+		// Least squares fit of value against rank.
+		var n, sx, sy, sxx, sxy float64
+		for rank, i := range order {
+			if !keep[i] {
+				continue
+			}
+			x := float64(rank)
+			n++
+			sx += x
+			sy += values[i]
+			sxx += x * x
+			sxy += x * values[i]
+		}
+
+		if n < 3 {
+			return
+		}
+
+		slope := (n*sxy - sx*sy) / (n*sxx - sx*sx)
+		intercept := (sy - slope*sx) / n
+
+		var deviation float64
+		for rank, i := range order {
+			if keep[i] {
+				deviation += math.Abs(values[i] - (intercept + slope*float64(rank)))
+			}
+		}
+		sigma := deviation / n
+
+		changed := false
+		for rank, i := range order {
+			fit := intercept + slope*float64(rank)
+			if keep[i] && (values[i] < fit-options.Low*sigma || values[i] > fit+options.High*sigma) {
+				keep[i] = false
+				changed = true
+			}
+		}
+
+		if !changed {
+			return
+		}
+	}
+}
+
+// rejectOutside clears keep for the values outside [lo, hi], and reports whether anything changed.
+// It never rejects the last two values, the ones farthest from center go first.
+func rejectOutside(values []float64, keep []bool, center, lo, hi float64) bool {
+	kept := 0
+	var outside []int
+	for i := range keep {
+		if !keep[i] {
+			continue
+		}
+		kept++
+		if values[i] < lo || values[i] > hi {
+			outside = append(outside, i)
+		}
+	}
+
+	sort.Slice(outside, func(a, b int) bool {
+		return math.Abs(values[outside[a]]-center) > math.Abs(values[outside[b]]-center)
+	})
+
+	changed := false
+	for _, i := range outside {
+		if kept <= 2 {
+			break
+		}
+		keep[i] = false
+		kept--
+		changed = true
+	}
+
+	return changed
+}
+
+func keptValues(values []float64, keep []bool) []float64 {
+	kept := make([]float64, 0, len(values))
+	for i := range values {
+		if keep[i] {
+			kept = append(kept, values[i])
+		}
+	}
+
+	return kept
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	c := len(sorted)
+	if c%2 == 1 {
+		return sorted[c/2]
+	}
+
+	return (sorted[c/2-1] + sorted[c/2]) / 2
+}
+
+func stdDev(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+
+	return math.Sqrt(variance / float64(len(values)))
+}
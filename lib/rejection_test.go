@@ -0,0 +1,111 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+func gray(values ...float64) []colorful.Color {
+	colors := make([]colorful.Color, len(values))
+	for i, v := range values {
+		colors[i] = colorful.Color{R: v, G: v, B: v}
+	}
+
+	return colors
+}
+
+func TestClipRejectsSatelliteTrail(t *testing.T) {
+	options := ClipOptions{Low: 3, High: 3, Iterations: 5}
+	// A bright satellite in one frame and a cold pixel in another.
+	colors := gray(0.20, 0.21, 0.19, 0.20, 0.22, 0.18, 0.20, 0.21, 0.19, 0.95, 0.01, 0.20)
+
+	merges := map[string]RejectionMerge{
+		"sigma":      SigmaClipColor(options),
+		"winsorized": WinsorizedSigmaClipColor(options),
+		"linearfit":  LinearFitClipColor(options),
+		"percentile": PercentileClipColor(ClipOptions{Low: 0.2, High: 0.1}),
+	}
+
+	for name, merge := range merges {
+		c, rejection := merge(colors, nil)
+		if rejection.High < 1 || rejection.Low < 1 {
+			t.Errorf("%s: expected both outliers rejected, got %+v", name, rejection)
+		}
+		if math.Abs(c.R-0.2) > 0.01 {
+			t.Errorf("%s: expected 0.2, got %f", name, c.R)
+		}
+	}
+}
+
+func TestClipKeepsSmallStacks(t *testing.T) {
+	c, rejection := SigmaClipColor(ClipOptions{Low: 1, High: 1, Iterations: 5})(gray(0.1, 0.9), nil)
+	if rejection.Low != 0 || rejection.High != 0 || math.Abs(c.R-0.5) > 1e-9 {
+		t.Errorf("Two frames should be averaged, got %f %+v", c.R, rejection)
+	}
+}
+
+func TestWeightedAverage(t *testing.T) {
+	c, _ := WeightedAverageColor(gray(0.1, 0.4), []float64{2, 1})
+	if math.Abs(c.R-0.2) > 1e-9 {
+		t.Errorf("Expected 0.2, got %f", c.R)
+	}
+}
+
+func TestPercentileClipAroundNegativeMedian(t *testing.T) {
+	merge := PercentileClipColor(ClipOptions{Low: 0.2, High: 0.2})
+
+	// A calibrated background can be below zero, a satellite is still the only outlier.
+	c, rejection := merge(gray(-0.010, -0.011, -0.009, -0.010, 0.5), nil)
+	if rejection.Low != 0 || rejection.High != 1 || math.Abs(c.R+0.01) > 1e-9 {
+		t.Errorf("expected only the satellite rejected and -0.01, got %f %+v", c.R, rejection)
+	}
+
+	// Around a zero median everything else is outside, the two values closest to it are kept.
+	c, _ = merge(gray(0.9, 0, 0.002, 0, -0.5), nil)
+	if c.R != 0 {
+		t.Errorf("expected the zeros to be kept, got %f", c.R)
+	}
+}
+
+func TestRejectOutsideFarthestFirst(t *testing.T) {
+	values := []float64{0.12, 0.5, 0.1, 0.9}
+	keep := []bool{true, true, true, true}
+	rejectOutside(values, keep, 0.1, 0.1, 0.1)
+
+	if !keep[0] || keep[1] || !keep[2] || keep[3] {
+		t.Errorf("expected the values closest to the center to be kept, got %v", keep)
+	}
+}
+
+func TestWeightedMedian(t *testing.T) {
+	for _, colors := range [][]colorful.Color{gray(0.3, 0.1, 0.2), gray(0.4, 0.1, 0.3, 0.2)} {
+		c, _ := WeightedMedianColor(colors, nil)
+		if expected := LinearMedianColor(colors); math.Abs(c.R-expected.R) > 1e-9 {
+			t.Errorf("equal weights: expected the median %f, got %f", expected.R, c.R)
+		}
+	}
+
+	c, _ := WeightedMedianColor(gray(0.1, 0.2, 0.9), []float64{1, 1, 3})
+	if c.R != 0.9 {
+		t.Errorf("expected the heaviest value 0.9, got %f", c.R)
+	}
+}
+
+func TestStackWeighsCoverage(t *testing.T) {
+	bounds := image.Rect(0, 0, 2, 1)
+	dark, bright := planar.New(bounds, 1), planar.New(bounds, 1)
+	bright.Channels[0][0], bright.Channels[0][1] = 1, 1
+	// The bright frame was warped, it covers half of the first pixel and none of the second.
+	bright.Alpha = []float32{0.5, 0}
+
+	output, _, err := StarpackRejection(context.Background(), []*planar.Image{dark, bright}, nil, WeightedAverageColor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, "coverage weighted average", output, 1.0/3, 0)
+}
@@ -0,0 +1,146 @@
+package starpack
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+)
+
+// FrameScore is the quality of a frame compared to the reference frame.
+type FrameScore struct {
+	FrameQuality
+	// StarRatio is the number of stars relative to the reference frame, clouds lower it.
+	StarRatio float64
+	// Alignment is the fraction of the stars that land on a reference star with the transformation found by FindOffset,
+	// out of the stars of whichever of the two frames has fewer. 1 is a perfect match.
+	Alignment float64
+}
+
+// SelectionOptions configures SelectFrames.
+type SelectionOptions struct {
+	// Sigma rejects frames that are worse than the median by this many robust standard deviations
+	// in any of the metrics. 0 disables it.
+	Sigma float64
+	// KeepBest is the fraction of the frames to keep, ranked by their combined score. 0 keeps everything.
+	KeepBest float64
+}
+
+// FrameSelection is the verdict on a frame.
+type FrameSelection struct {
+	Keep    bool
+	Reasons []string
+}
+
+// metric is a single measurement of the frames, higherIsBetter tells which side is bad.
+type metric struct {
+	name           string
+	higherIsBetter bool
+	value          func(FrameScore) float64
+}
+
+var selectionMetrics = []metric{
+	{"star count", true, func(s FrameScore) float64 { return s.StarRatio }},
+	{"FWHM", false, func(s FrameScore) float64 { return s.FWHM }},
+	{"eccentricity", false, func(s FrameScore) float64 { return s.Eccentricity }},
+	{"background", false, func(s FrameScore) float64 { return s.Background }},
+	{"alignment", true, func(s FrameScore) float64 { return s.Alignment }},
+}
+
+// ScoreFrames measures every frame against the first one, on Threads workers.
+func ScoreFrames(images []*planar.Image) []FrameScore {
+	referenceMap, sigma := GetStarmap(images[0], 0)
+
+	scores := make([]FrameScore, len(images))
+	ParallelFrames(context.Background(), 0, len(images), func(i int) {
+		scores[i].FrameQuality = MeasureFrame(images[i], sigma)
+		if i == 0 {
+			scores[i].Alignment = 1
+			return
+		}
+
+		sMap, _ := GetStarmap(images[i], sigma)
+		scores[i].Alignment = alignmentScore(referenceMap, sMap, findOffset(referenceMap, sMap))
+	})
+
+	for i := range scores {
+		if scores[0].Stars > 0 {
+			scores[i].StarRatio = float64(scores[i].Stars) / float64(scores[0].Stars)
+		}
+	}
+
+	return scores
+}
+
+// alignmentScore is the fraction of the stars that pair up with the reference within refineDistance after the transformation.
+func alignmentScore(referenceMap, sMap starmap.Starmap, config starmap.OffsetConfig) float64 {
+	stars := min(len(referenceMap.Stars), len(sMap.Stars))
+	if stars == 0 {
+		return 0
+	}
+
+	return math.Min(float64(len(referenceMap.Pairs(sMap, config, refineDistance)))/float64(stars), 1)
+}
+
+// SelectFrames drops the outliers and keeps the best frames.
+func SelectFrames(scores []FrameScore, options SelectionOptions) []FrameSelection {
+	selections := make([]FrameSelection, len(scores))
+	combined := make([]float64, len(scores))
+	for i := range selections {
+		selections[i].Keep = true
+	}
+
+	for _, m := range selectionMetrics {
+		values := make([]float64, len(scores))
+		for i := range scores {
+			values[i] = m.value(scores[i])
+		}
+
+		center := median(values)
+		deviations := make([]float64, len(values))
+		for i := range values {
+			deviations[i] = math.Abs(values[i] - center)
+		}
+		sigma := math.Max(median(deviations)*madToSigma, math.Abs(center)*1e-3)
+		if sigma == 0 {
+			continue
+		}
+
+		for i := range values {
+			// Positive is worse than the median.
+			badness := (values[i] - center) / sigma
+			if m.higherIsBetter {
+				badness = -badness
+			}
+			combined[i] -= badness
+
+			if options.Sigma > 0 && badness > options.Sigma {
+				selections[i].Keep = false
+				selections[i].Reasons = append(selections[i].Reasons, fmt.Sprintf("%s %.3f (median %.3f)", m.name, values[i], center))
+			}
+		}
+	}
+
+	if options.KeepBest > 0 && options.KeepBest < 1 {
+		order := make([]int, len(scores))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return combined[order[i]] > combined[order[j]]
+		})
+
+		keep := int(math.Ceil(options.KeepBest * float64(len(scores))))
+		for rank, i := range order {
+			if rank >= keep && selections[i].Keep {
+				selections[i].Keep = false
+				selections[i].Reasons = append(selections[i].Reasons, fmt.Sprintf("not in the best %.0f%% (rank %d)", options.KeepBest*100, rank+1))
+			}
+		}
+	}
+
+	return selections
+}
@@ -0,0 +1,88 @@
+package starpack
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+func TestSelectFramesRejectsClouds(t *testing.T) {
+	var scores []FrameScore
+	for i := 0; i < 10; i++ {
+		s := FrameScore{StarRatio: 1 + float64(i%3)*0.02, Alignment: 0.9 + float64(i%2)*0.01}
+		s.FWHM = 3 + float64(i%4)*0.1
+		s.Eccentricity = 0.1 + float64(i%3)*0.01
+		s.Background = 0.1 + float64(i%5)*0.001
+		scores = append(scores, s)
+	}
+	// Thin clouds: fewer stars, brighter sky.
+	scores[7].StarRatio = 0.4
+	scores[7].Background = 0.3
+
+	selections := SelectFrames(scores, SelectionOptions{Sigma: 5})
+	for i := range selections {
+		if selections[i].Keep != (i != 7) {
+			t.Errorf("Frame %d: keep %v, reasons %v", i, selections[i].Keep, selections[i].Reasons)
+		}
+	}
+	if len(selections[7].Reasons) != 2 {
+		t.Errorf("Expected star count and background as reasons, got %v", selections[7].Reasons)
+	}
+}
+
+func TestSelectFramesKeepBest(t *testing.T) {
+	scores := make([]FrameScore, 10)
+	for i := range scores {
+		scores[i].StarRatio = 1
+		scores[i].Alignment = 1
+		scores[i].FWHM = float64(2 + i)
+	}
+
+	kept := 0
+	for i, s := range SelectFrames(scores, SelectionOptions{KeepBest: 0.3}) {
+		if s.Keep {
+			kept++
+			if i > 2 {
+				t.Errorf("Frame %d with FWHM %f should not be kept", i, scores[i].FWHM)
+			}
+		}
+	}
+	if kept != 3 {
+		t.Errorf("Expected 3 frames kept, got %d", kept)
+	}
+}
+
+func TestScoreFramesAlignsMeridianFlip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	bounds := image.Rect(0, 0, 200, 120)
+	randomStars := func() []syntheticStar {
+		var stars []syntheticStar
+		for i := 0; i < 25; i++ {
+			stars = append(stars, syntheticStar{10 + r.Float64()*180, 10 + r.Float64()*100, 1.2, 1.2, 0.2 + r.Float64()*0.6})
+		}
+		return stars
+	}
+
+	stars := randomStars()
+	// After a meridian flip the frame is rotated by 180 degrees, and here also dithered further than the brute force search.
+	var flipped []syntheticStar
+	for _, s := range stars {
+		s.x, s.y = float64(bounds.Dx()-1)-s.x+45, float64(bounds.Dy()-1)-s.y
+		flipped = append(flipped, s)
+	}
+
+	frames := []*planar.Image{
+		starField(bounds, stars, gaussianProfile),
+		starField(bounds, flipped, gaussianProfile),
+		starField(bounds, randomStars(), gaussianProfile),
+	}
+	scores := ScoreFrames(frames)
+	if scores[1].Alignment < 0.9 {
+		t.Errorf("expected the flipped frame to align, got %+v", scores[1])
+	}
+	if scores[2].Alignment > 0.5 {
+		t.Errorf("expected a different field not to align, got %+v", scores[2])
+	}
+}
@@ -1,18 +1,22 @@
 package starpack
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
 	_ "image/jpeg"
-	"log"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/Coornail/starpack/fits"
+	"github.com/Coornail/starpack/planar"
 	"github.com/Coornail/starpack/starmap"
+	"github.com/Coornail/starpack/xisf"
 	"github.com/disintegration/imaging"
 	colorful "github.com/lucasb-eyer/go-colorful"
 	"github.com/pkg/errors"
@@ -21,92 +25,196 @@ import (
 
 const (
 	delta = 0.1
+
+	// Maximum distance in pixels between stars paired for sub-pixel alignment.
+	refineDistance = 3.0
 )
 
-func Starpack(images []image.Image, colorMergeMethod ColorMerge) *image.RGBA64 {
+var supportedExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".tif":  true,
+	".tiff": true,
+	".png":  true,
+	".fits": true,
+	".fit":  true,
+	".fts":  true,
+}
+
+// Starpack merges images of the same size pixel by pixel.
+// Warped frames only take part in the pixels they cover, but partly covered pixels count fully.
+// StarpackRejection with WeightedAverageColor or WeightedMedianColor weighs them by their coverage.
+// Progress is reported as the "Merging" stage, it can be nil.
+func Starpack(ctx context.Context, images []*planar.Image, colorMergeMethod ColorMerge, progress Progress) (*planar.Image, error) {
+	output, _, err := stack(ctx, images, nil, NoRejection(colorMergeMethod), false, progress)
+
+	return output, err
+}
+
+// StarpackRejection merges the images and also returns how many frames were rejected at each pixel, row by row.
+// Weights are passed on to the merge, nil weighs every frame equally.
+func StarpackRejection(ctx context.Context, images []*planar.Image, weights []float64, merge RejectionMerge, progress Progress) (*planar.Image, []Rejection, error) {
+	output, statistics, err := stack(ctx, images, weights, merge, true, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rejections := make([]Rejection, len(statistics))
+	for i := range statistics {
+		rejections[i] = statistics[i].rejection
+	}
+
+	return output, rejections, nil
+}
+
+type pixelStatistics struct {
+	// Number of frames that cover the pixel, rejected or not.
+	frames    int
+	rejection Rejection
+	// Standard deviation of the luminance of the contributing frames.
+	noise float64
+}
+
+// stack merges images of the same size. The output is mono only if every input is.
+func stack(ctx context.Context, images []*planar.Image, weights []float64, merge RejectionMerge, withStatistics bool, progress Progress) (*planar.Image, []pixelStatistics, error) {
 	bounds := images[0].Bounds()
-	output := image.NewRGBA64(bounds)
-
-	var currentColor []colorful.Color
-	var wg sync.WaitGroup
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			currentColor = make([]colorful.Color, len(images))
-
-			wg.Add(1)
-			go func(x, y int, currentColor []colorful.Color) {
-				defer wg.Done()
-				for i := range images {
-					currX := x
-					currY := y
-					if currX < bounds.Min.X || currX >= bounds.Max.X ||
-						currY < bounds.Min.Y || currY >= bounds.Max.Y {
+	channels := 1
+	for i := range images {
+		channels = max(channels, len(images[i].Channels))
+	}
+	output := planar.New(bounds, channels)
+
+	var statistics []pixelStatistics
+	if withStatistics {
+		statistics = make([]pixelStatistics, bounds.Dx()*bounds.Dy())
+	}
+
+	// Frames with an alpha only take part in the pixels they cover, weighted by the coverage if the merge takes weights.
+	masked := false
+	for i := range images {
+		masked = masked || images[i].Alpha != nil
+	}
+
+	merged := newCounter(progress, "Merging", bounds.Dy())
+	err := parallelRows(ctx, bounds, func(minY, maxY int) {
+		currentColor := make([]colorful.Color, 0, len(images))
+		currentWeights := make([]float64, 0, len(images))
+		for i := output.Offset(bounds.Min.X, minY); i < output.Offset(bounds.Min.X, maxY); i++ {
+			currentColor, currentWeights = currentColor[:0], currentWeights[:0]
+			for f := range images {
+				w := 1.0
+				if weights != nil {
+					w = weights[f]
+				}
+				if alpha := images[f].Alpha; alpha != nil {
+					if alpha[i] <= 0 {
 						continue
 					}
+					w *= float64(alpha[i])
+				}
+				currentColor = append(currentColor, colorAt(images[f], i))
+				currentWeights = append(currentWeights, w)
+			}
+			if len(currentColor) == 0 {
+				continue
+			}
 
-					currentColor[i] = rgbaToColorful(images[i].At(currX, currY))
+			pixelWeights := weights
+			if masked {
+				pixelWeights = currentWeights
+			}
+			mergedColor, rejection := merge(currentColor, pixelWeights)
+			setColor(output, i, mergedColor)
+			if withStatistics {
+				statistics[i] = pixelStatistics{
+					frames:    len(currentColor),
+					rejection: rejection,
+					noise:     contributingNoise(currentColor, rejection),
 				}
-				r, g, b, a := colorMergeMethod(currentColor).RGBA()
-				output.SetRGBA64(x, y, color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)})
-			}(x, y, currentColor)
+			}
 		}
-		wg.Wait()
-		fmt.Printf("Merging: %.2f%%\r", float64(y)/float64(bounds.Max.Y)*100.0)
+
+		merged.add(maxY - minY)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	fmt.Printf("\n")
 
-	return output
+	return output, statistics, nil
 }
 
-func RemoveLightPollutionImage(img, mask image.Image) image.Image {
+func RemoveLightPollutionImage(img, mask *planar.Image) *planar.Image {
 	bounds := img.Bounds()
-	output := image.NewNRGBA64(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			currColor := rgbaToColorful(img.At(x, y))
-			maskColor := rgbaToColorful(mask.At(x, y))
+	output := planar.New(bounds, len(img.Channels))
 
-			currH, currS, currV := currColor.Hsv()
-			maskH, maskS, maskV := maskColor.Hsv()
-			output.Set(x, y, colorful.Hsv(currH-maskH, currS-maskS, currV-maskV).Clamped())
+	parallelRows(context.Background(), bounds, func(minY, maxY int) {
+		for i := img.Offset(bounds.Min.X, minY); i < img.Offset(bounds.Min.X, maxY); i++ {
+			currH, currS, currV := colorAt(img, i).Clamped().Hsv()
+			maskH, maskS, maskV := colorAt(mask, i).Clamped().Hsv()
+			setColor(output, i, colorful.Hsv(currH-maskH, currS-maskS, currV-maskV).Clamped())
 		}
-	}
+	})
 
 	return output
 }
 
-func LoadImages(images []string) []image.Image {
-	var files []string
-	for _, file := range images {
-		files = append(files, collectFiles(file)...)
+// FrameErrors are the files that could not be loaded, by file name.
+type FrameErrors map[string]error
+
+func (e FrameErrors) Error() string {
+	files := make([]string, 0, len(e))
+	for file := range e {
+		files = append(files, file)
 	}
-	images = files
+	sort.Strings(files)
 
-	loadedImages := make([]image.Image, len(images))
+	if len(files) == 1 {
+		return e[files[0]].Error()
+	}
 
-	var wg sync.WaitGroup
-	for i := range images {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
+	return fmt.Sprintf("%d frames could not be loaded, first: %s", len(files), e[files[0]])
+}
 
-			loadedImages[i] = LoadImage(images[i])
-		}(i)
+// LoadImages loads the files, directories are expanded to the supported images inside them.
+// A file that cannot be read does not stop the others from loading: its image is nil and the error is FrameErrors.
+// Progress is reported as the "Loading" stage in frames, it can be nil.
+func LoadImages(ctx context.Context, images []string, progress Progress) ([]*planar.Image, error) {
+	images, err := CollectFiles(images)
+	if err != nil {
+		return nil, err
 	}
 
-	wg.Wait()
+	loadedImages := make([]*planar.Image, len(images))
+	loaded := newCounter(progress, "Loading", len(images))
+	frameErrors := make(FrameErrors)
+
+	var mu sync.Mutex
+	err = ParallelFrames(ctx, 0, len(images), func(i int) {
+		img, err := LoadImage(images[i])
+		if err != nil {
+			mu.Lock()
+			frameErrors[images[i]] = err
+			mu.Unlock()
+		}
+		loadedImages[i] = img
+		loaded.add(1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(frameErrors) > 0 {
+		return loadedImages, frameErrors
+	}
 
-	return loadedImages
+	return loadedImages, nil
 }
 
 func fileVisit(files *[]string) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		ext := filepath.Ext(info.Name())
-		if !info.IsDir() && (ext == ".jpg" || ext == ".jpeg" || ext == ".tif" || ext == ".tiff" || ext == ".png") {
+		if !info.IsDir() && supportedExtensions[strings.ToLower(filepath.Ext(info.Name()))] {
 			*files = append(*files, path)
 		}
 
@@ -114,56 +222,71 @@ func fileVisit(files *[]string) filepath.WalkFunc {
 	}
 }
 
-func collectFiles(file string) []string {
+// CollectFiles expands directories into the supported image files inside them.
+func CollectFiles(paths []string) ([]string, error) {
 	var files []string
-	filepath.Walk(file, fileVisit(&files))
+	for _, file := range paths {
+		collected, err := collectFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, collected...)
+	}
 
-	return files
+	return files, nil
 }
 
-func LoadImage(filename string) image.Image {
-	var currImg *os.File
-	var err error
-
-	handleError := func(err error) {
-		err = errors.Wrapf(err, "for image: %s", filename)
-		panic(err)
+func collectFiles(file string) ([]string, error) {
+	var files []string
+	if err := filepath.Walk(file, fileVisit(&files)); err != nil {
+		return nil, errors.Wrapf(err, "collecting images from %s", file)
 	}
 
-	if currImg, err = os.Open(filename); err != nil {
-		handleError(err)
+	return files, nil
+}
+
+func LoadImage(filename string) (*planar.Image, error) {
+	currImg, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "for image: %s", filename)
 	}
 	defer currImg.Close()
 
 	decoded, _, err := image.Decode(currImg)
 	if err != nil {
-		handleError(err)
+		return nil, errors.Wrapf(err, "for image: %s", filename)
 	}
 
-	return decoded
+	return planar.FromImage(decoded), nil
 }
 
 // Single pixel denoising.
-func DenoiseImage(img image.Image) image.Image {
+// Progress is reported as the "Denoising" stage in rows, it can be nil.
+func DenoiseImage(ctx context.Context, img *planar.Image, progress Progress) (*planar.Image, error) {
 	bounds := img.Bounds()
-	output := image.NewNRGBA64(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			averageColor := getNeighborAverageColor(img, x, y)
-			currColor := img.At(x, y)
-			if distance(rgbaToColorful(currColor), rgbaToColorful(averageColor)) > delta {
-				output.Set(x, y, averageColor)
-			} else {
-				output.Set(x, y, currColor)
+	output := img.Copy()
+	denoised := newCounter(progress, "Denoising", bounds.Dy())
+
+	err := parallelRows(ctx, bounds, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := img.Offset(x, y)
+				averageColor := getNeighborAverageColor(img, x, y)
+				if distance(colorAt(img, i).Clamped(), averageColor) > delta {
+					setColor(output, i, averageColor)
+				}
 			}
 		}
+		denoised.add(maxY - minY)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return output
+	return output, nil
 }
 
-func getNeighborAverageColor(img image.Image, x, y int) color.Color {
+func getNeighborAverageColor(img *planar.Image, x, y int) colorful.Color {
 	colors := make([]colorful.Color, 0)
 	bounds := img.Bounds()
 
@@ -172,7 +295,7 @@ func getNeighborAverageColor(img image.Image, x, y int) color.Color {
 			if outOfBounds(x+i, y+j, bounds) || (i == 0 && j == 0) {
 				continue
 			}
-			colors = append(colors, rgbaToColorful(img.At(x+i, y+j)))
+			colors = append(colors, colorAt(img, img.Offset(x+i, y+j)).Clamped())
 		}
 	}
 
@@ -180,120 +303,205 @@ func getNeighborAverageColor(img image.Image, x, y int) color.Color {
 }
 
 func outOfBounds(x, y int, bounds image.Rectangle) bool {
-	return x < bounds.Min.X || x > bounds.Max.X || y < bounds.Min.Y || y > bounds.Max.Y
+	return !(image.Point{X: x, Y: y}).In(bounds)
 }
 
-func Upscale(images []image.Image) []image.Image {
+// Upscale resizes every image to double size.
+//
+// Deprecated: it adds no resolution, use Drizzle.
+func Upscale(images []*planar.Image) []*planar.Image {
 	bounds := images[0].Bounds()
 	width := bounds.Max.X * 2
 	height := bounds.Max.Y * 2
 
 	for i := range images {
-		images[i] = imaging.Resize(images[i], width, height, imaging.Gaussian)
+		images[i] = planar.FromImage(imaging.Resize(images[i].ToImage(), width, height, imaging.Gaussian))
 	}
 
 	return images
 }
 
-func StarTrack(images []image.Image) []image.Image {
+// StarTrack aligns the images to the first one and returns the offsets used for each.
+// Progress is reported as the "Finding offsets" and "Aligning" stages in frames, it can be nil.
+func StarTrack(ctx context.Context, images []*planar.Image, progress Progress) ([]*planar.Image, []starmap.OffsetConfig, error) {
+	offsets, err := FindOffsets(ctx, images, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aligned := newCounter(progress, "Aligning", len(images)-1)
+	errs := make([]error, len(images))
+	err = ParallelFrames(ctx, 1, len(images), func(i int) {
+		images[i], errs[i] = Transform(images[i], offsets[i])
+		aligned.add(1)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return images, offsets, nil
+}
+
+// FindOffsets finds the transformation from each image onto the first one, without modifying the images.
+func FindOffsets(ctx context.Context, images []*planar.Image, progress Progress) ([]starmap.OffsetConfig, error) {
+	if err := starmap.CheckModel(AlignmentModel); err != nil {
+		return nil, err
+	}
+	if err := CheckPSF(PSF); err != nil {
+		return nil, err
+	}
+
 	reference := images[0]
-	referenceMap, treshold := GetStarmap(reference, 0)
-	fmt.Printf("Treshold: %f\n", treshold)
+	referenceMap, sigma := GetStarmap(reference, 0)
 
-	var wg sync.WaitGroup
-	for i := 1; i < len(images); i++ {
-		wg.Add(1)
-		go func(i int) {
-			sMap, _ := GetStarmap(images[i], treshold)
-			config, maxCorrect := sMap.FindOffset(referenceMap)
-			fmt.Printf("%#v (%f)\n", config, maxCorrect)
-			images[i] = Transform(images[i], config)
-			wg.Done()
-		}(i)
+	offsets := make([]starmap.OffsetConfig, len(images))
+	found := newCounter(progress, "Finding offsets", len(images)-1)
+	err := ParallelFrames(ctx, 1, len(images), func(i int) {
+		offsets[i] = FindOffset(referenceMap, sigma, images[i])
+		found.add(1)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	wg.Wait()
+	return offsets, nil
+}
 
-	return images
+// AlignmentModel is the transformation fitted to the matched stars, one of starmap.Models or starmap.ModelAuto.
+var AlignmentModel = starmap.ModelAuto
+
+// FindOffset finds the transformation of a single image onto the reference starmap,
+// sigma is the detection treshold the reference was detected with.
+// Stars are matched by triangles and fitted with AlignmentModel,
+// the brute force search is only used when too few of them match.
+func FindOffset(referenceMap starmap.Starmap, sigma float64, img *planar.Image) starmap.OffsetConfig {
+	sMap, _ := GetStarmap(img, sigma)
+
+	return findOffset(referenceMap, sMap)
 }
 
-func Transform(img image.Image, config starmap.OffsetConfig) image.Image {
-	if config.Rotation != 0 {
-		img = imaging.Rotate(img, config.Rotation, color.RGBA{R: 0, G: 0, B: 0, A: 0})
+// findOffset is FindOffset for a frame whose stars are already detected.
+func findOffset(referenceMap, sMap starmap.Starmap) starmap.OffsetConfig {
+	config, err := referenceMap.MatchTriangles(sMap, AlignmentModel)
+	if err == nil {
+		return config
 	}
-	img = Translate(img, config.X, config.Y)
 
-	return img
+	config, _ = referenceMap.FindOffset(sMap)
+	return referenceMap.RefineOffset(sMap, config, refineDistance)
 }
 
-func Translate(img image.Image, dx, dy int) *image.NRGBA64 {
-	bounds := img.Bounds()
-	output := image.NewNRGBA64(bounds)
+// Transform warps the image onto the reference frame with Interpolation and ClampInterpolation, see Warp.
+func Transform(img *planar.Image, config starmap.OffsetConfig) (*planar.Image, error) {
+	return Warp(img, config, Interpolation, ClampInterpolation)
+}
+
+// Translate shifts the image by whole pixels, see Warp.
+func Translate(img *planar.Image, dx, dy int) *planar.Image {
+	output, _ := Warp(img, starmap.OffsetConfig{Matrix: starmap.Translation(float64(dx), float64(dy))}, InterpolationNearest, false)
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			if x+dx < bounds.Max.X && y+dy < bounds.Max.Y {
-				output.Set(x+dx, y+dy, img.At(x, y))
-			}
-		}
-	}
 	return output
 }
 
 func SaveImage(fileName string, image image.Image) error {
-	f, _ := os.Create(fileName)
+	return SaveImageWithHistory(fileName, image, History{})
+}
+
+// SaveImageWithHistory picks the output format from the file extension.
+// FITS and XISF are written as 32-bit float with the history in the header, anything else is TIFF.
+func SaveImageWithHistory(fileName string, image image.Image, history History) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "saving %s", fileName)
+	}
 	defer f.Close()
 
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".fits", ".fit", ".fts":
+		return fits.Encode(f, image, history.Header())
+	case ".xisf":
+		return xisf.Encode(f, image, history.Header())
+	}
+
+	if p, ok := image.(planar.Planar); ok {
+		// The tiff encoder only knows the standard library image types.
+		image = p.PlanarImage().ToImage()
+	}
+
 	return tiff.Encode(f, image, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 }
 
+// brightnessMap is the brightness of every pixel, row by row.
+func brightnessMap(img image.Image) []float64 {
+	bounds := img.Bounds()
+	values := make([]float64, bounds.Dx()*bounds.Dy())
+	p, isPlanar := img.(planar.Planar)
+
+	parallelRows(context.Background(), bounds, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+				if isPlanar {
+					c := colorAt(p.PlanarImage(), i).Clamped()
+					values[i] = luminance([3]float64{c.R, c.G, c.B})
+				} else {
+					values[i] = brightness(img.At(x, y))
+				}
+			}
+		}
+	})
+
+	return values
+}
+
 func brightness(col color.Color) float64 {
 	c := rgbaToColorful(col)
 	return float64(c.R)*0.299 + float64(c.G)*0.587 + float64(c.B)*0.114
 }
 
-func GetStarmap(img image.Image, treshold float64) (starmap.Starmap, float64) {
-	// Filter for brightness.
+// GetStarmap detects the 100 brightest stars, see DetectStars.
+func GetStarmap(img image.Image, sigma float64) (starmap.Starmap, float64) {
+	sm, sigma := DetectStars(img, sigma)
+	sm.Stars = sm.Stars[0:min(100, len(sm.Stars))]
+
+	return sm, sigma
+}
+
+// DetectStars finds every star brighter than the local background by sigma times the local noise, brightest first,
+// and returns the sigma it used. A zero sigma is DetectionSigma.
+// The stars are measured on the background subtracted image, see measureStars.
+func DetectStars(img image.Image, sigma float64) (starmap.Starmap, float64) {
+	if sigma == 0 {
+		sigma = DetectionSigma
+	}
+
 	bounds := img.Bounds()
-	var brightPoints []image.Point
-
-	if treshold == 0 {
-		for treshold = 1.0; len(brightPoints) < 10 && treshold > 0.2; treshold -= 0.01 {
-			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-				for x := bounds.Min.X; x < bounds.Max.X; x++ {
-					v := brightness(img.At(x, y))
-					if v > treshold {
-						brightPoints = append(brightPoints, image.Point{X: x, Y: y})
-					}
-				}
-			}
-		}
-	} else {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+	values := brightnessMap(img)
+	mesh := newBackgroundMesh(values, bounds)
+	tresholds := make([]float64, len(values))
+	parallelRows(context.Background(), bounds, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
 			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				v := brightness(img.At(x, y))
-				if v > treshold {
-					brightPoints = append(brightPoints, image.Point{X: x, Y: y})
-				}
+				i := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+				values[i] -= mesh.Background(x, y)
+				tresholds[i] = sigma * mesh.Noise(x, y)
 			}
 		}
-	}
-
-	sm := starmap.Starmap{Bounds: bounds}
-	for i := range brightPoints {
-		sm.Stars = append(sm.Stars, starmap.Star{X: float64(brightPoints[i].X), Y: float64(brightPoints[i].Y), Size: 1})
-	}
+	})
 
-	sm = sm.Compress()
-	fmt.Printf("Found %d stars (%f)\n", len(brightPoints), treshold)
+	sm := starmap.Starmap{Bounds: bounds, Stars: components(values, tresholds, bounds)}
+	sm = measureStars(sm, values, mesh)
 
-	// Find 10 biggest stars.
 	sort.Slice(sm.Stars, func(i, j int) bool {
-		return sm.Stars[i].Size > sm.Stars[j].Size
+		return sm.Stars[i].Brightness() > sm.Stars[j].Brightness()
 	})
-	sm.Stars = sm.Stars[0:min(100, len(sm.Stars))]
 
-	return sm, treshold
+	return sm, sigma
 }
 
 func min(a, b int) int {
@@ -302,3 +510,10 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
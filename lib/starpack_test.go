@@ -0,0 +1,108 @@
+package starpack
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadImagesKeepsGoingPastBadFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.png")
+	f, err := os.Create(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewGray16(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	bad := filepath.Join(dir, "bad.jpg")
+	if err := ioutil.WriteFile(bad, []byte("not a jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := LoadImages(context.Background(), []string{bad, good}, nil)
+	frameErrors, ok := err.(FrameErrors)
+	if !ok || len(frameErrors) != 1 || frameErrors[bad] == nil {
+		t.Fatalf("expected an error for %s only, got %v", bad, err)
+	}
+	if images[0] != nil || images[1] == nil || images[1].Bounds().Dx() != 4 {
+		t.Fatalf("expected only the good image to load, got %v", images)
+	}
+
+	if _, err := CollectFiles([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+	if err := SaveImage(filepath.Join(dir, "missing", "out.tif"), images[1]); err == nil {
+		t.Error("expected an error saving into a missing directory")
+	}
+}
+
+// cancelAfter cancels the stage once it has done enough work, recording how much was done in the end.
+type cancelAfter struct {
+	mu     sync.Mutex
+	stage  string
+	after  int
+	done   int
+	cancel context.CancelFunc
+}
+
+func (p *cancelAfter) Progress(stage string, done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stage != p.stage {
+		return
+	}
+	p.done = max(p.done, done)
+	if done >= p.after {
+		p.cancel()
+	}
+}
+
+func TestLoadImagesCancel(t *testing.T) {
+	defer func(threads int) { Threads = threads }(Threads)
+	Threads = 2
+
+	dir, err := ioutil.TempDir("", "starpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files []string
+	for i := 0; i < 10; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("frame%d.png", i))
+		f, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, image.NewGray16(image.Rect(0, 0, 4, 3))); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		files = append(files, file)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := &cancelAfter{stage: "Loading", after: 3, cancel: cancel}
+	if _, err := LoadImages(ctx, files, progress); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	// The other worker may finish the frame it was loading when the stage was cancelled, but starts no new one.
+	if progress.done < 3 || progress.done > 3+Threads-1 {
+		t.Errorf("expected loading to stop after 3 frames, %d were loaded", progress.done)
+	}
+}
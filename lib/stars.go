@@ -0,0 +1,239 @@
+package starpack
+
+import (
+	"image"
+	"math"
+
+	"github.com/Coornail/starpack/starmap"
+)
+
+const (
+	// Limits of the window a star is measured in, in pixels from its peak.
+	minStarRadius = 3
+	maxStarRadius = 30
+	// Rounds of moving the measuring window onto the centroid.
+	centroidIterations = 3
+	// Moments are measured on the pixels this many sigmas of the noise above the background,
+	// positive noise in the window would widen every star.
+	measureSigma = 3
+)
+
+// starRadius is the radius of the window that a star of size pixels is measured in.
+func starRadius(size float64) int {
+	radius := int(math.Ceil(2*math.Sqrt(size/math.Pi))) + 2
+
+	return min(max(radius, minStarRadius), maxStarRadius)
+}
+
+// measureStars moves every cluster of bright pixels onto its brightest pixel and measures the star around it.
+// Values are the background subtracted brightness, row by row. Clusters that lead to the same peak are a single star.
+func measureStars(sm starmap.Starmap, values []float64, mesh *backgroundMesh) starmap.Starmap {
+	bounds := sm.Bounds
+	measured := starmap.Starmap{Bounds: bounds}
+	peaks := make(map[image.Point]bool)
+
+	for _, s := range sm.Stars {
+		radius := starRadius(s.Size)
+		peak := localMaximum(values, bounds, image.Point{X: int(math.Round(s.X)), Y: int(math.Round(s.Y))}, 2*radius)
+		if peaks[peak] {
+			continue
+		}
+		peaks[peak] = true
+
+		star, ok := measureStar(values, bounds, peak, radius, measureSigma*mesh.Noise(peak.X, peak.Y))
+		if !ok {
+			continue
+		}
+		star.Size = s.Size
+		measured.Stars = append(measured.Stars, star)
+	}
+
+	return measured
+}
+
+// localMaximum climbs from p to the brightest neighbour until there is no brighter one, for at most steps pixels.
+func localMaximum(values []float64, bounds image.Rectangle, p image.Point, steps int) image.Point {
+	width := bounds.Dx()
+	value := func(p image.Point) float64 {
+		return values[(p.Y-bounds.Min.Y)*width+p.X-bounds.Min.X]
+	}
+
+	for step := 0; step < steps; step++ {
+		best := p
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				n := image.Point{X: p.X + dx, Y: p.Y + dy}
+				if n.In(bounds) && value(n) > value(best) {
+					best = n
+				}
+			}
+		}
+		if best == p {
+			break
+		}
+		p = best
+	}
+
+	return p
+}
+
+// measureStar measures the star around peak from the intensity weighted moments of the pixels within radius
+// that are above the floor, and refines it with a PSF fit of every pixel unless PSF is PSFNone.
+func measureStar(values []float64, bounds image.Rectangle, peak image.Point, radius int, floor float64) (starmap.Star, bool) {
+	width := bounds.Dx()
+	value := func(x, y int) float64 {
+		return values[(y-bounds.Min.Y)*width+x-bounds.Min.X]
+	}
+
+	star := starmap.Star{X: float64(peak.X), Y: float64(peak.Y), Peak: value(peak.X, peak.Y)}
+	r2 := float64(radius * radius)
+
+	// The window follows the centroid, so a star found off center is measured symmetrically.
+	var samples []psfSample
+	for iteration := 0; iteration < centroidIterations; iteration++ {
+		samples = samples[:0]
+		cx, cy := int(math.Round(star.X)), int(math.Round(star.Y))
+		var total, sumX, sumY float64
+		for y := cy - radius; y <= cy+radius; y++ {
+			for x := cx - radius; x <= cx+radius; x++ {
+				dx, dy := float64(x)-star.X, float64(y)-star.Y
+				if !(image.Point{X: x, Y: y}).In(bounds) || dx*dx+dy*dy > r2 {
+					continue
+				}
+
+				v := value(x, y)
+				samples = append(samples, psfSample{float64(x), float64(y), v})
+				if v > floor {
+					total += v
+					sumX += float64(x) * v
+					sumY += float64(y) * v
+				}
+			}
+		}
+
+		if total <= 0 {
+			return star, false
+		}
+		star.X, star.Y, star.Flux = sumX/total, sumY/total, total
+	}
+
+	// Eigenvalues of the covariance matrix are the variances along the major and minor axes.
+	var xx, yy, xy float64
+	for _, p := range samples {
+		if p.v <= floor {
+			continue
+		}
+		dx, dy := p.x-star.X, p.y-star.Y
+		xx += p.v * dx * dx
+		yy += p.v * dy * dy
+		xy += p.v * dx * dy
+	}
+	xx /= star.Flux
+	yy /= star.Flux
+	xy /= star.Flux
+
+	d := math.Sqrt((xx-yy)*(xx-yy)/4 + xy*xy)
+	major := (xx+yy)/2 + d
+	minor := math.Max((xx+yy)/2-d, 0)
+	if major > 0 {
+		star.FWHM = sigmaToFWHM * math.Sqrt((major+minor)/2)
+		star.Eccentricity = math.Sqrt(1 - minor/major)
+	}
+
+	if PSF != PSFNone {
+		if fitted, ok := fitPSF(PSF, samples, star, float64(radius)); ok {
+			star = fitted
+		}
+	}
+
+	return star, true
+}
+
+// components labels the 8-connected groups of values above the treshold of their pixel and returns each group
+// as a star at its mean position, with its number of pixels as the size.
+// It is a single pass with union-find, keeping the labels of only the previous row.
+func components(values, tresholds []float64, bounds image.Rectangle) []starmap.Star {
+	type blob struct {
+		pixels, sumX, sumY float64
+	}
+
+	width := bounds.Dx()
+	// Label 0 is the background.
+	parent := []int32{0}
+	blobs := []blob{{}}
+
+	find := func(l int32) int32 {
+		for parent[l] != l {
+			parent[l] = parent[parent[l]]
+			l = parent[l]
+		}
+		return l
+	}
+	union := func(a, b int32) int32 {
+		a, b = find(a), find(b)
+		if a == b {
+			return a
+		}
+		if b < a {
+			a, b = b, a
+		}
+		parent[b] = a
+		blobs[a].pixels += blobs[b].pixels
+		blobs[a].sumX += blobs[b].sumX
+		blobs[a].sumY += blobs[b].sumY
+		blobs[b] = blob{}
+		return a
+	}
+
+	previous, current := make([]int32, width), make([]int32, width)
+	for row := 0; row < bounds.Dy(); row++ {
+		for x := 0; x < width; x++ {
+			current[x] = 0
+			if i := row*width + x; values[i] <= tresholds[i] {
+				continue
+			}
+
+			// The neighbours that are already labeled: left, and the three above.
+			var label int32
+			neighbours := [4]int32{previous[x]}
+			if x > 0 {
+				neighbours[1], neighbours[2] = current[x-1], previous[x-1]
+			}
+			if x+1 < width {
+				neighbours[3] = previous[x+1]
+			}
+			for _, n := range neighbours {
+				if n == 0 {
+					continue
+				}
+				if label == 0 {
+					label = find(n)
+				} else {
+					label = union(label, n)
+				}
+			}
+
+			if label == 0 {
+				label = int32(len(parent))
+				parent = append(parent, label)
+				blobs = append(blobs, blob{})
+			}
+			current[x] = label
+			b := &blobs[label]
+			b.pixels++
+			b.sumX += float64(bounds.Min.X + x)
+			b.sumY += float64(bounds.Min.Y + row)
+		}
+		previous, current = current, previous
+	}
+
+	var stars []starmap.Star
+	for l, b := range blobs {
+		if b.pixels == 0 || find(int32(l)) != int32(l) {
+			continue
+		}
+		stars = append(stars, starmap.Star{X: b.sumX / b.pixels, Y: b.sumY / b.pixels, Size: b.pixels})
+	}
+
+	return stars
+}
@@ -0,0 +1,238 @@
+package starpack
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+type syntheticStar struct {
+	x, y, sigmaX, sigmaY, amplitude float64
+}
+
+// starField draws gaussian stars, aligned with the axes, on a noisy background.
+func starField(bounds image.Rectangle, stars []syntheticStar, profile func(s syntheticStar, dx, dy float64) float64) *planar.Image {
+	r := rand.New(rand.NewSource(1))
+	img := planar.New(bounds, 1)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := 0.1 + 0.002*r.NormFloat64()
+			for _, s := range stars {
+				v += profile(s, float64(x)-s.x, float64(y)-s.y)
+			}
+			img.Channels[0][img.Offset(x, y)] = float32(v)
+		}
+	}
+
+	return img
+}
+
+func gaussianProfile(s syntheticStar, dx, dy float64) float64 {
+	return s.amplitude * math.Exp(-dx*dx/(2*s.sigmaX*s.sigmaX)-dy*dy/(2*s.sigmaY*s.sigmaY))
+}
+
+func TestDetectStarsMeasuresStars(t *testing.T) {
+	defer func(psf string) { PSF = psf }(PSF)
+
+	bounds := image.Rect(0, 0, 120, 80)
+	stars := []syntheticStar{
+		{30.3, 20.7, 1.5, 1.5, 0.6},
+		{80.55, 50.2, 2, 1, 0.4},
+		{60.1, 65.9, 1.2, 1.2, 0.3},
+	}
+	img := starField(bounds, stars, gaussianProfile)
+
+	for _, psf := range []string{PSFNone, PSFGaussian} {
+		PSF = psf
+		sm, _ := DetectStars(img, 0)
+		if len(sm.Stars) != len(stars) {
+			t.Fatalf("%s: expected %d stars, got %+v", psf, len(stars), sm.Stars)
+		}
+
+		// Moments only see the core above the noise, the fit recovers the whole profile.
+		tolerance := 0.15
+		if psf == PSFGaussian {
+			tolerance = 0.03
+		}
+
+		for i, expected := range stars {
+			s := sm.Stars[i]
+			if d := math.Hypot(s.X-expected.x, s.Y-expected.y); d > 0.05 {
+				t.Errorf("%s: star %d at %f,%f, expected %f,%f", psf, i, s.X, s.Y, expected.x, expected.y)
+			}
+
+			fwhm := sigmaToFWHM * math.Sqrt((expected.sigmaX*expected.sigmaX+expected.sigmaY*expected.sigmaY)/2)
+			if math.Abs(s.FWHM-fwhm) > tolerance*fwhm {
+				t.Errorf("%s: star %d FWHM %f, expected %f", psf, i, s.FWHM, fwhm)
+			}
+
+			// Eccentricity changes quickly near round, a 1% longer axis is already 0.14.
+			eccentricity := math.Sqrt(1 - math.Pow(math.Min(expected.sigmaX, expected.sigmaY)/math.Max(expected.sigmaX, expected.sigmaY), 2))
+			if eccentricity == 0 && s.Eccentricity > 0.3 || eccentricity > 0 && math.Abs(s.Eccentricity-eccentricity) > 0.05 {
+				t.Errorf("%s: star %d eccentricity %f, expected %f", psf, i, s.Eccentricity, eccentricity)
+			}
+
+			flux := 2 * math.Pi * expected.amplitude * expected.sigmaX * expected.sigmaY
+			if psf == PSFGaussian && math.Abs(s.Flux-flux) > tolerance*flux {
+				t.Errorf("%s: star %d flux %f, expected %f", psf, i, s.Flux, flux)
+			}
+			if psf == PSFGaussian && math.Abs(s.Peak-expected.amplitude) > tolerance*expected.amplitude {
+				t.Errorf("%s: star %d peak %f, expected %f", psf, i, s.Peak, expected.amplitude)
+			}
+		}
+	}
+}
+
+func TestFitMoffat(t *testing.T) {
+	defer func(psf string) { PSF = psf }(PSF)
+	PSF = PSFMoffat
+
+	const alpha, beta = 2.0, 3.0
+	star := syntheticStar{x: 20.4, y: 19.8, amplitude: 0.5}
+	img := starField(image.Rect(0, 0, 40, 40), []syntheticStar{star}, func(s syntheticStar, dx, dy float64) float64 {
+		return s.amplitude * math.Pow(1+(dx*dx+dy*dy)/(alpha*alpha), -beta)
+	})
+
+	sm, _ := DetectStars(img, 0)
+	if len(sm.Stars) != 1 {
+		t.Fatalf("expected a single star, got %+v", sm.Stars)
+	}
+
+	s := sm.Stars[0]
+	fwhm := 2 * alpha * math.Sqrt(math.Pow(2, 1/beta)-1)
+	if math.Hypot(s.X-star.x, s.Y-star.y) > 0.02 || math.Abs(s.FWHM-fwhm) > 0.03*fwhm || s.Eccentricity > 0.3 {
+		t.Errorf("expected a round star at %f,%f with FWHM %f, got %+v", star.x, star.y, fwhm, s)
+	}
+}
+
+func TestCheckPSF(t *testing.T) {
+	for _, psf := range []string{PSFNone, PSFGaussian, PSFMoffat} {
+		if err := CheckPSF(psf); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := CheckPSF("gausian"); err == nil {
+		t.Error("expected an error for a misspelled psf")
+	}
+}
+
+// BenchmarkDetectStarsBusyField is a dense star field, like the Milky Way.
+func BenchmarkDetectStarsBusyField(b *testing.B) {
+	r := rand.New(rand.NewSource(2))
+	bounds := image.Rect(0, 0, 512, 512)
+	stars := make([]syntheticStar, 3000)
+	for i := range stars {
+		sigma := 0.8 + r.Float64()
+		stars[i] = syntheticStar{r.Float64() * 512, r.Float64() * 512, sigma, sigma, 0.1 + r.Float64()*0.8}
+	}
+	img := planar.New(bounds, 1)
+	for _, s := range stars {
+		for y := int(s.y) - 6; y <= int(s.y)+6; y++ {
+			for x := int(s.x) - 6; x <= int(s.x)+6; x++ {
+				if (image.Point{X: x, Y: y}).In(bounds) {
+					img.Channels[0][img.Offset(x, y)] += float32(gaussianProfile(s, float64(x)-s.x, float64(y)-s.y))
+				}
+			}
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DetectStars(img, 0)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	// A U joined only on its last row, and a single pixel.
+	mask := []string{
+		"#...#...",
+		"#...#..#",
+		"#...#...",
+		"#####...",
+	}
+	bounds := image.Rect(10, 20, 18, 24)
+	values := make([]float64, bounds.Dx()*bounds.Dy())
+	for y, row := range mask {
+		for x, c := range row {
+			if c == '#' {
+				values[y*bounds.Dx()+x] = 1
+			}
+		}
+	}
+
+	tresholds := make([]float64, len(values))
+	for i := range tresholds {
+		tresholds[i] = 0.5
+	}
+
+	stars := components(values, tresholds, bounds)
+	if len(stars) != 2 {
+		t.Fatalf("expected 2 components, got %+v", stars)
+	}
+	if s := stars[0]; s.Size != 11 || math.Abs(s.X-12) > 1e-9 || math.Abs(s.Y-(20+21.0/11)) > 1e-9 {
+		t.Errorf("unexpected U component %+v", s)
+	}
+	if s := stars[1]; s.Size != 1 || s.X != 17 || s.Y != 21 {
+		t.Errorf("unexpected single pixel component %+v", s)
+	}
+}
+
+func TestBackgroundMesh(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	bounds := image.Rect(0, 0, 256, 192)
+	background := func(x, y int) float64 { return 0.05 + 0.06*float64(x)/256 + 0.03*float64(y)/192 }
+	values := make([]float64, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			values[y*bounds.Dx()+x] = background(x, y) + 0.01*r.NormFloat64()
+		}
+	}
+	// A bright star in every box must not pull the background up.
+	for y := 32; y < bounds.Dy(); y += 64 {
+		for x := 32; x < bounds.Dx(); x += 64 {
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					values[(y+dy)*bounds.Dx()+x+dx] += 0.8
+				}
+			}
+		}
+	}
+
+	mesh := newBackgroundMesh(values, bounds)
+	for _, p := range []image.Point{{10, 10}, {128, 96}, {200, 40}, {250, 180}} {
+		if b := mesh.Background(p.X, p.Y); math.Abs(b-background(p.X, p.Y)) > 0.003 {
+			t.Errorf("background at %v is %f, expected %f", p, b, background(p.X, p.Y))
+		}
+		if n := mesh.Noise(p.X, p.Y); math.Abs(n-0.01) > 0.002 {
+			t.Errorf("noise at %v is %f, expected 0.01", p, n)
+		}
+	}
+}
+
+func TestDetectStarsOnGradient(t *testing.T) {
+	// Light pollution brightens the right side far more than the faint star on the left.
+	bounds := image.Rect(0, 0, 256, 128)
+	stars := []syntheticStar{
+		{40.2, 60.7, 1.5, 1.5, 0.04},
+		{220.6, 30.1, 1.5, 1.5, 0.3},
+	}
+	img := starField(bounds, stars, gaussianProfile)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.Channels[0][img.Offset(x, y)] += float32(0.06 * float64(x) / 256)
+		}
+	}
+
+	sm, _ := DetectStars(img, 0)
+	if len(sm.Stars) != len(stars) {
+		t.Fatalf("expected %d stars, got %+v", len(stars), sm.Stars)
+	}
+	for i, expected := range []syntheticStar{stars[1], stars[0]} {
+		if s := sm.Stars[i]; math.Hypot(s.X-expected.x, s.Y-expected.y) > 0.3 {
+			t.Errorf("star %d at %f,%f, expected %f,%f", i, s.X, s.Y, expected.x, expected.y)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package starpack
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/Coornail/starpack/planar"
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+// StackResult is the merged image together with per-pixel statistics of the stack.
+// The maps have a single channel, the count maps are scaled so that 1 means every frame.
+type StackResult struct {
+	Image *planar.Image
+	// Frames rejected below and above the accepted range.
+	LowRejection  *planar.Image
+	HighRejection *planar.Image
+	// Frames that made it into the merged pixel.
+	Contributing *planar.Image
+	// Standard deviation of the luminance of the contributing frames.
+	Noise *planar.Image
+	// SNR is the mean luminance of the stack over its mean noise (sigma / sqrt(contributing frames)).
+	SNR float64
+}
+
+// StarpackStatistics merges the images like StarpackRejection, and measures the stack.
+func StarpackStatistics(ctx context.Context, images []*planar.Image, weights []float64, merge RejectionMerge, progress Progress) (*StackResult, error) {
+	output, statistics, err := stack(ctx, images, weights, merge, true, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := output.Bounds()
+	frames := float64(len(images))
+
+	result := &StackResult{
+		Image:         output,
+		LowRejection:  planar.New(bounds, 1),
+		HighRejection: planar.New(bounds, 1),
+		Contributing:  planar.New(bounds, 1),
+		Noise:         planar.New(bounds, 1),
+	}
+
+	var signal, noise float64
+	for i, s := range statistics {
+		contributing := float64(s.frames - s.rejection.Low - s.rejection.High)
+
+		result.LowRejection.Channels[0][i] = float32(float64(s.rejection.Low) / frames)
+		result.HighRejection.Channels[0][i] = float32(float64(s.rejection.High) / frames)
+		result.Contributing.Channels[0][i] = float32(contributing / frames)
+		result.Noise.Channels[0][i] = float32(s.noise)
+
+		signal += pixelLuminance(output, i)
+		noise += s.noise / math.Sqrt(math.Max(contributing, 1))
+	}
+
+	if noise > 0 {
+		result.SNR = signal / noise
+	}
+
+	return result, nil
+}
+
+// contributingNoise is the standard deviation of the luminance of the frames that were not rejected.
+// Clipping happens per channel, so the rejected frames are assumed to be the darkest and brightest ones.
+func contributingNoise(colors []colorful.Color, rejection Rejection) float64 {
+	values := make([]float64, len(colors))
+	for i := range colors {
+		values[i] = luminance([3]float64{colors[i].R, colors[i].G, colors[i].B})
+	}
+	sort.Float64s(values)
+
+	if rejection.Low+rejection.High < len(values) {
+		values = values[rejection.Low : len(values)-rejection.High]
+	}
+
+	return stdDev(values)
+}
@@ -0,0 +1,48 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+func TestStarpackStatistics(t *testing.T) {
+	// 14 frames alternate around 0.2 with a standard deviation of 0.02, the last one has a satellite in the first pixel.
+	bounds := image.Rect(0, 0, 2, 2)
+	var frames []*planar.Image
+	for i := 0; i < 15; i++ {
+		v := float32(0.2)
+		if i < 14 {
+			v = 0.18 + 0.04*float32(i%2)
+		}
+		frame := planar.New(bounds, 1)
+		for p := range frame.Channels[0] {
+			frame.Channels[0][p] = v
+		}
+		frames = append(frames, frame)
+	}
+	frames[14].Channels[0][0] = 0.95
+
+	result, err := StarpackStatistics(context.Background(), frames, nil, SigmaClipColor(ClipOptions{Low: 3, High: 3, Iterations: 5}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The satellite is rejected, nothing else is.
+	expectValues(t, "low rejection", result.LowRejection, 0, 0, 0, 0)
+	expectValues(t, "high rejection", result.HighRejection, 1.0/15, 0, 0, 0)
+	expectValues(t, "contributing", result.Contributing, 14.0/15, 1, 1, 1)
+	expectValues(t, "image", result.Image, 0.2, 0.2, 0.2, 0.2)
+
+	// The last frame is at the mean of the others, it lowers their standard deviation.
+	noise := 0.02 * math.Sqrt(14.0/15)
+	expectValues(t, "noise", result.Noise, 0.02, float32(noise), float32(noise), float32(noise))
+
+	snr := 4 * 0.2 / (0.02/math.Sqrt(14) + 3*noise/math.Sqrt(15))
+	if math.Abs(result.SNR-snr) > 1e-3*snr {
+		t.Errorf("expected an SNR of %f, got %f", snr, result.SNR)
+	}
+}
@@ -0,0 +1,248 @@
+package starpack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+const bytesPerSample = 4
+
+// FrameCache keeps preprocessed frames on disk as raw float32 planes,
+// so that a stack only needs a band of rows of every frame in memory.
+type FrameCache struct {
+	dir string
+	// The cache created the directory and removes it on Close.
+	temporary bool
+	frames    []cachedFrame
+}
+
+type cachedFrame struct {
+	path     string
+	rect     image.Rectangle
+	channels int
+	// The alpha is stored after the channels.
+	alpha bool
+}
+
+// NewFrameCache stores frames in dir, or in a new temporary directory if dir is empty.
+func NewFrameCache(dir string) (*FrameCache, error) {
+	if dir != "" {
+		return &FrameCache{dir: dir}, os.MkdirAll(dir, 0755)
+	}
+
+	dir, err := ioutil.TempDir("", "starpack")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating frame cache")
+	}
+
+	return &FrameCache{dir: dir, temporary: true}, nil
+}
+
+// Add writes a frame to the cache, one channel after the other.
+// Every frame has to have the bounds of the first one, StarpackTiled merges them row by row.
+func (c *FrameCache) Add(img *planar.Image) error {
+	if len(c.frames) > 0 && img.Bounds() != c.frames[0].rect {
+		return errors.Errorf("caching frame: bounds %v differ from the first frame %v", img.Bounds(), c.frames[0].rect)
+	}
+
+	frame := cachedFrame{
+		path:     filepath.Join(c.dir, "frame"+strconv.Itoa(len(c.frames))+".raw"),
+		rect:     img.Bounds(),
+		channels: len(img.Channels),
+		alpha:    img.Alpha != nil,
+	}
+	planes := img.Channels
+	if frame.alpha {
+		planes = append(planes[:len(planes):len(planes)], img.Alpha)
+	}
+
+	f, err := os.Create(frame.path)
+	if err != nil {
+		return errors.Wrap(err, "caching frame")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	buf := make([]byte, bytesPerSample)
+	for _, plane := range planes {
+		for _, v := range plane {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(v))
+			if _, err := w.Write(buf); err != nil {
+				return errors.Wrap(err, "caching frame")
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "caching frame")
+	}
+
+	c.frames = append(c.frames, frame)
+
+	return nil
+}
+
+// Len is the number of cached frames.
+func (c *FrameCache) Len() int {
+	return len(c.frames)
+}
+
+// Bounds of a cached frame.
+func (c *FrameCache) Bounds(frame int) image.Rectangle {
+	return c.frames[frame].rect
+}
+
+// ReadRows reads the rows from minY up to maxY of a cached frame.
+func (c *FrameCache) ReadRows(frame, minY, maxY int) (*planar.Image, error) {
+	cached := c.frames[frame]
+	rect := image.Rect(cached.rect.Min.X, minY, cached.rect.Max.X, maxY).Intersect(cached.rect)
+	img := planar.New(rect, cached.channels)
+	planes := img.Channels
+	if cached.alpha {
+		img.Alpha = make([]float32, len(img.Channels[0]))
+		planes = append(planes[:len(planes):len(planes)], img.Alpha)
+	}
+
+	f, err := os.Open(cached.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cached frame")
+	}
+	defer f.Close()
+
+	width := cached.rect.Dx()
+	buf := make([]byte, len(img.Channels[0])*bytesPerSample)
+	for p, plane := range planes {
+		// Planes are stored one after the other, so the rows of a plane are contiguous.
+		offset := int64(p*cached.rect.Dy()+rect.Min.Y-cached.rect.Min.Y) * int64(width) * bytesPerSample
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return nil, errors.Wrap(err, "reading cached frame")
+		}
+		for i := range plane {
+			plane[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*bytesPerSample:]))
+		}
+	}
+
+	return img, nil
+}
+
+// Close removes the cached frames.
+func (c *FrameCache) Close() error {
+	if c.temporary {
+		return os.RemoveAll(c.dir)
+	}
+
+	for _, frame := range c.frames {
+		if err := os.Remove(frame.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StarpackTiled merges the cached frames band by band, like StarpackRejection.
+// The bands are sized so that the rows read from all frames fit in maxMemory bytes.
+// Progress is reported as the "Merging" stage in rows, it can be nil.
+func StarpackTiled(ctx context.Context, cache *FrameCache, weights []float64, merge RejectionMerge, maxMemory int64, progress Progress) (*planar.Image, error) {
+	bounds := cache.Bounds(0)
+	channels := 1
+	planes := 0
+	for i := range cache.frames {
+		channels = max(channels, cache.frames[i].channels)
+		planes += cache.frames[i].channels
+		if cache.frames[i].alpha {
+			planes++
+		}
+	}
+
+	rowSize := int64(planes*bounds.Dx()) * bytesPerSample
+	rows := int(maxMemory / rowSize)
+	if rows < 1 {
+		rows = 1
+	}
+
+	output := planar.New(bounds, channels)
+	merged := newCounter(progress, "Merging", bounds.Dy())
+	tiles := make([]*planar.Image, cache.Len())
+	for minY := bounds.Min.Y; minY < bounds.Max.Y; minY += rows {
+		maxY := min(minY+rows, bounds.Max.Y)
+		for f := range tiles {
+			var err error
+			tiles[f], err = cache.ReadRows(f, minY, maxY)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		band, _, err := stack(ctx, tiles, weights, merge, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		offset := output.Offset(bounds.Min.X, minY)
+		for ch := range band.Channels {
+			copy(output.Channels[ch][offset:], band.Channels[ch])
+		}
+		merged.add(maxY - minY)
+	}
+
+	return output, nil
+}
+
+// MeanStack averages frames as they are added, without keeping them.
+// The running mean is updated in place, so it only takes the memory of a single frame.
+type MeanStack struct {
+	mean *planar.Image
+	// Total weight of each pixel, frames with an alpha only add to the pixels they cover.
+	weights []float64
+}
+
+// Add merges a frame into the mean, mono frames are added to every channel.
+func (m *MeanStack) Add(img *planar.Image, weight float64) {
+	if weight <= 0 {
+		return
+	}
+
+	if m.mean == nil {
+		m.mean = planar.New(img.Bounds(), len(img.Channels))
+		m.weights = make([]float64, len(m.mean.Channels[0]))
+	}
+
+	if len(img.Channels) > len(m.mean.Channels) {
+		// A color frame after mono ones, the mean so far is gray.
+		expanded := planar.New(m.mean.Bounds(), len(img.Channels))
+		for ch := range expanded.Channels {
+			copy(expanded.Channels[ch], m.mean.Channels[0])
+		}
+		m.mean = expanded
+	}
+
+	for i := range m.weights {
+		w := weight
+		if img.Alpha != nil {
+			w *= float64(img.Alpha[i])
+		}
+		if w <= 0 {
+			continue
+		}
+
+		m.weights[i] += w
+		fraction := float32(w / m.weights[i])
+		for ch := range m.mean.Channels {
+			m.mean.Channels[ch][i] += (img.Channel(ch)[i] - m.mean.Channels[ch][i]) * fraction
+		}
+	}
+}
+
+// Image is the mean of the frames added so far, black where no frame covers it.
+func (m *MeanStack) Image() *planar.Image {
+	return m.mean
+}
@@ -0,0 +1,127 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+)
+
+func gradientFrame(bounds image.Rectangle, channels int, offset float32) *planar.Image {
+	img := planar.New(bounds, channels)
+	for ch := range img.Channels {
+		for i := range img.Channels[ch] {
+			img.Channels[ch][i] = float32(i%7)/10 + float32(ch)/20 + offset
+		}
+	}
+
+	return img
+}
+
+func TestStarpackTiledMatchesStarpack(t *testing.T) {
+	bounds := image.Rect(0, 0, 5, 9)
+	frames := []*planar.Image{
+		gradientFrame(bounds, 3, 0),
+		gradientFrame(bounds, 3, 0.1),
+		gradientFrame(bounds, 3, -0.05),
+	}
+	// A warped frame that does not cover the first rows.
+	frames[1].Alpha = make([]float32, bounds.Dx()*bounds.Dy())
+	for i := 2 * bounds.Dx(); i < len(frames[1].Alpha); i++ {
+		frames[1].Alpha[i] = 1
+	}
+
+	cache, err := NewFrameCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for _, f := range frames {
+		if err := cache.Add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merge := NoRejection(LinearMedianColor)
+	expected, err := Starpack(context.Background(), frames, LinearMedianColor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two rows of every frame and the alpha per band.
+	tiled, err := StarpackTiled(context.Background(), cache, nil, merge, int64(2*(len(frames)*3+1)*bounds.Dx()*bytesPerSample), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ch := range expected.Channels {
+		for i := range expected.Channels[ch] {
+			if tiled.Channels[ch][i] != expected.Channels[ch][i] {
+				t.Fatalf("channel %d pixel %d: expected %f, got %f", ch, i, expected.Channels[ch][i], tiled.Channels[ch][i])
+			}
+		}
+	}
+}
+
+func TestFrameCacheRejectsOtherSizes(t *testing.T) {
+	cache, err := NewFrameCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if err := cache.Add(gradientFrame(image.Rect(0, 0, 4, 3), 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Add(gradientFrame(image.Rect(0, 0, 4, 5), 1, 0)); err == nil {
+		t.Error("expected an error for a frame of a different size")
+	}
+	if cache.Len() != 1 {
+		t.Errorf("expected only the first frame cached, got %d", cache.Len())
+	}
+}
+
+func TestMeanStack(t *testing.T) {
+	bounds := image.Rect(0, 0, 4, 3)
+	var mean MeanStack
+	mean.Add(gradientFrame(bounds, 1, 0), 1)
+	mean.Add(gradientFrame(bounds, 3, 0.3), 2)
+
+	expected := gradientFrame(bounds, 3, 0.2)
+	// The mono frame is gray, without the channel offset.
+	for ch := range expected.Channels {
+		for i := range expected.Channels[ch] {
+			expected.Channels[ch][i] -= float32(ch) / 20 / 3
+		}
+	}
+
+	output := mean.Image()
+	for ch := range expected.Channels {
+		for i := range expected.Channels[ch] {
+			if math.Abs(float64(output.Channels[ch][i]-expected.Channels[ch][i])) > 1e-6 {
+				t.Fatalf("channel %d pixel %d: expected %f, got %f", ch, i, expected.Channels[ch][i], output.Channels[ch][i])
+			}
+		}
+	}
+}
+
+func TestMeanStackAlpha(t *testing.T) {
+	bounds := image.Rect(0, 0, 4, 3)
+	var mean MeanStack
+	mean.Add(gradientFrame(bounds, 1, 0), 1)
+
+	// A frame that only covers the first pixel.
+	partial := gradientFrame(bounds, 1, 1)
+	partial.Alpha = make([]float32, bounds.Dx()*bounds.Dy())
+	partial.Alpha[0] = 1
+	mean.Add(partial, 3)
+
+	output := mean.Image()
+	if v := output.Channels[0][0]; math.Abs(float64(v)-0.75) > 1e-6 {
+		t.Errorf("expected the weighted mean on the covered pixel, got %f", v)
+	}
+	if v := output.Channels[0][1]; math.Abs(float64(v)-0.1) > 1e-6 {
+		t.Errorf("expected the uncovered pixel to keep the first frame, got %f", v)
+	}
+}
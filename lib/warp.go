@@ -0,0 +1,179 @@
+package starpack
+
+import (
+	"context"
+	"math"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+	"github.com/pkg/errors"
+)
+
+const (
+	InterpolationNearest  = "nearest"
+	InterpolationBilinear = "bilinear"
+	// InterpolationBicubic is the Catmull-Rom spline.
+	InterpolationBicubic  = "bicubic"
+	InterpolationLanczos3 = "lanczos3"
+	InterpolationLanczos4 = "lanczos4"
+)
+
+// Interpolation and ClampInterpolation are the Warp options Transform uses.
+var (
+	Interpolation      = InterpolationLanczos3
+	ClampInterpolation = true
+)
+
+// kernel is a separable interpolation kernel, it weighs the input pixels closer than radius along each axis.
+type kernel struct {
+	radius int
+	weight func(t float64) float64
+}
+
+var kernels = map[string]kernel{
+	InterpolationNearest: {1, func(t float64) float64 {
+		if t >= -0.5 && t < 0.5 {
+			return 1
+		}
+		return 0
+	}},
+	InterpolationBilinear: {1, func(t float64) float64 {
+		return math.Max(1-math.Abs(t), 0)
+	}},
+	InterpolationBicubic: {2, func(t float64) float64 {
+		const a = -0.5
+		t = math.Abs(t)
+		switch {
+		case t < 1:
+			return (a+2)*t*t*t - (a+3)*t*t + 1
+		case t < 2:
+			return a*t*t*t - 5*a*t*t + 8*a*t - 4*a
+		}
+		return 0
+	}},
+	InterpolationLanczos3: {3, lanczos(3)},
+	InterpolationLanczos4: {4, lanczos(4)},
+}
+
+func lanczos(n float64) func(t float64) float64 {
+	return func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		if math.Abs(t) >= n {
+			return 0
+		}
+
+		pt := math.Pi * t
+		return n * math.Sin(pt) * math.Sin(pt/n) / (pt * pt)
+	}
+}
+
+// Warp resamples the image onto the reference frame with the interpolation kernel, see starmap.OffsetConfig.Project.
+// The output keeps the bounds of the input. Its Alpha is the fraction of each pixel that the input covers,
+// so merges leave out the uncovered edges instead of averaging them in as black.
+// With clamp the interpolated values stay within the range of the four closest input pixels,
+// otherwise the negative lobes of the bicubic and Lanczos kernels ring around bright stars.
+func Warp(img *planar.Image, config starmap.OffsetConfig, interpolation string, clamp bool) (*planar.Image, error) {
+	k, ok := kernels[interpolation]
+	if !ok {
+		return nil, errors.Errorf("unknown interpolation: %q", interpolation)
+	}
+
+	bounds := img.Bounds()
+	output := planar.New(bounds, len(img.Channels))
+	output.Alpha = make([]float32, len(output.Channels[0]))
+	inverse, ok := config.Inverse()
+	if !ok {
+		return output, nil
+	}
+
+	// The input covers from the left edge of its first pixel to the right edge of its last one.
+	minX, maxX := float64(bounds.Min.X)-0.5, float64(bounds.Max.X)-0.5
+	minY, maxY := float64(bounds.Min.Y)-0.5, float64(bounds.Max.Y)-0.5
+
+	parallelRows(context.Background(), bounds, func(bandMinY, bandMaxY int) {
+		taps := 2 * k.radius
+		weightsX, weightsY := make([]float64, taps), make([]float64, taps)
+		sums := make([]float64, len(img.Channels))
+
+		for y := bandMinY; y < bandMaxY; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				sx, sy := inverse.Apply(float64(x), float64(y))
+				coverage := overlap(sx, minX, maxX) * overlap(sy, minY, maxY)
+				if coverage <= 0 {
+					continue
+				}
+
+				x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+				firstX, firstY := x0-k.radius+1, y0-k.radius+1
+				for t := 0; t < taps; t++ {
+					weightsX[t] = k.weight(sx - float64(firstX+t))
+					weightsY[t] = k.weight(sy - float64(firstY+t))
+				}
+
+				// Taps outside of the input are left out and the rest renormalized.
+				var total float64
+				for ch := range sums {
+					sums[ch] = 0
+				}
+				for ty := 0; ty < taps; ty++ {
+					py := firstY + ty
+					if py < bounds.Min.Y || py >= bounds.Max.Y || weightsY[ty] == 0 {
+						continue
+					}
+					for tx := 0; tx < taps; tx++ {
+						px := firstX + tx
+						if px < bounds.Min.X || px >= bounds.Max.X || weightsX[tx] == 0 {
+							continue
+						}
+
+						w := weightsX[tx] * weightsY[ty]
+						src := img.Offset(px, py)
+						for ch := range sums {
+							sums[ch] += w * float64(img.Channels[ch][src])
+						}
+						total += w
+					}
+				}
+				if total <= 1e-6 {
+					continue
+				}
+
+				dst := output.Offset(x, y)
+				output.Alpha[dst] = float32(coverage)
+				for ch := range sums {
+					v := sums[ch] / total
+					if clamp {
+						low, high := neighbourRange(img.Channels[ch], img, x0, y0)
+						v = math.Min(math.Max(v, low), high)
+					}
+					output.Channels[ch][dst] = float32(v)
+				}
+			}
+		}
+	})
+
+	return output, nil
+}
+
+// overlap is the length of the pixel centered at v that falls between min and max, at most 1.
+func overlap(v, min, max float64) float64 {
+	return math.Max(math.Min(v+0.5, max)-math.Max(v-0.5, min), 0)
+}
+
+// neighbourRange is the smallest and biggest value of the up to four input pixels from x0, y0 to x0+1, y0+1.
+func neighbourRange(channel []float32, img *planar.Image, x0, y0 int) (float64, float64) {
+	low, high := math.Inf(1), math.Inf(-1)
+	for y := y0; y <= y0+1; y++ {
+		for x := x0; x <= x0+1; x++ {
+			if outOfBounds(x, y, img.Rect) {
+				continue
+			}
+			v := float64(channel[img.Offset(x, y)])
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+
+	return low, high
+}
@@ -0,0 +1,118 @@
+package starpack
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/Coornail/starpack/starmap"
+)
+
+func TestWarpWholePixels(t *testing.T) {
+	bounds := image.Rect(0, 0, 9, 7)
+	img := gradientFrame(bounds, 3, 0)
+	config := starmap.NewOffsetConfig(2, -1, 0, bounds)
+
+	for interpolation := range kernels {
+		warped, err := Warp(img, config, interpolation, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				dst := warped.Offset(x, y)
+				if outOfBounds(x-2, y+1, bounds) {
+					if warped.Alpha[dst] != 0 {
+						t.Fatalf("%s: pixel %d,%d is not covered, got alpha %f", interpolation, x, y, warped.Alpha[dst])
+					}
+					continue
+				}
+
+				src := img.Offset(x-2, y+1)
+				if warped.Alpha[dst] != 1 {
+					t.Fatalf("%s: pixel %d,%d is covered, got alpha %f", interpolation, x, y, warped.Alpha[dst])
+				}
+				for ch := range img.Channels {
+					if math.Abs(float64(warped.Channels[ch][dst]-img.Channels[ch][src])) > 1e-6 {
+						t.Fatalf("%s: channel %d pixel %d,%d: expected %f, got %f", interpolation, ch, x, y, img.Channels[ch][src], warped.Channels[ch][dst])
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := Warp(img, config, "sinc", false); err == nil {
+		t.Error("expected an error for an unknown interpolation")
+	}
+}
+
+func TestWarpHalfPixel(t *testing.T) {
+	bounds := image.Rect(0, 0, 6, 5)
+	img := gradientFrame(bounds, 1, 0)
+	config := starmap.OffsetConfig{Matrix: starmap.Translation(0.5, 0)}
+
+	bilinear, _ := Warp(img, config, InterpolationBilinear, false)
+	x, y := 3, 2
+	expected := (img.Channels[0][img.Offset(x-1, y)] + img.Channels[0][img.Offset(x, y)]) / 2
+	if got := bilinear.Channels[0][bilinear.Offset(x, y)]; math.Abs(float64(got-expected)) > 1e-6 {
+		t.Errorf("expected %f, got %f", expected, got)
+	}
+
+	// Half of the first column is outside of the input.
+	if alpha := bilinear.Alpha[bilinear.Offset(0, y)]; alpha != 0.5 {
+		t.Errorf("expected alpha 0.5 on the edge, got %f", alpha)
+	}
+}
+
+func TestWarpClamping(t *testing.T) {
+	// A single bright star on a dark background.
+	bounds := image.Rect(0, 0, 11, 11)
+	img := planar.New(bounds, 1)
+	img.Channels[0][img.Offset(5, 5)] = 1
+	config := starmap.OffsetConfig{Matrix: starmap.Translation(0.5, 0.5)}
+
+	ringing, _ := Warp(img, config, InterpolationLanczos3, false)
+	clamped, _ := Warp(img, config, InterpolationLanczos3, true)
+
+	var minRinging, minClamped float32
+	for i := range ringing.Channels[0] {
+		if ringing.Channels[0][i] < minRinging {
+			minRinging = ringing.Channels[0][i]
+		}
+		if clamped.Channels[0][i] < minClamped {
+			minClamped = clamped.Channels[0][i]
+		}
+	}
+
+	if minRinging >= 0 {
+		t.Errorf("expected the unclamped kernel to ring below zero")
+	}
+	if minClamped < 0 {
+		t.Errorf("expected clamping to remove the ringing, got %f", minClamped)
+	}
+}
+
+func TestStackLeavesOutUncoveredPixels(t *testing.T) {
+	bounds := image.Rect(0, 0, 3, 2)
+	dark, bright := planar.New(bounds, 1), planar.New(bounds, 1)
+	for i := range dark.Channels[0] {
+		dark.Channels[0][i] = 0.2
+		bright.Channels[0][i] = 0.6
+	}
+	bright.Alpha = []float32{0, 1, 1, 1, 1, 1}
+
+	output, err := Starpack(context.Background(), []*planar.Image{dark, bright}, LinearAverageColor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := output.Channels[0][0]; math.Abs(float64(v)-0.2) > 1e-6 {
+		t.Errorf("expected the uncovered pixel to come from the other frame, got %f", v)
+	}
+	if v := output.Channels[0][1]; math.Abs(float64(v)-0.4) > 1e-6 {
+		t.Errorf("expected the average of both frames, got %f", v)
+	}
+}
@@ -0,0 +1,160 @@
+package starpack
+
+import (
+	"math"
+
+	"github.com/Coornail/starpack/planar"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Scales the median absolute deviation to the standard deviation of a normal distribution.
+	madToSigma = 1.4826
+
+	backgroundSamples = 100000
+	// Number of the brightest stars measured for the FWHM.
+	fwhmStars = 50
+	// Converts the standard deviation of a gaussian to its full width at half maximum.
+	sigmaToFWHM = 2.3548
+)
+
+// Weighting schemes for FrameWeights.
+const (
+	WeightingNone     = "none"
+	WeightingFWHM     = "fwhm"
+	WeightingStars    = "stars"
+	WeightingNoise    = "noise"
+	WeightingSNR      = "snr"
+	WeightingCombined = "combined"
+)
+
+// FrameQuality is what is measured on a frame to weigh it in the stack.
+type FrameQuality struct {
+	// Stars detected above the detection treshold.
+	Stars int
+	// Median full width at half maximum of the stars, in pixels.
+	FWHM float64
+	// Median eccentricity of the stars, 0 is round.
+	Eccentricity float64
+	// Median luminance, mostly sky background.
+	Background float64
+	// Standard deviation of the background, estimated robustly.
+	Noise float64
+	// SNR is the mean luminance over the noise.
+	SNR float64
+}
+
+// MeasureFrame measures the stars and background of a frame, detecting stars at sigma, see DetectStars.
+func MeasureFrame(img *planar.Image, sigma float64) FrameQuality {
+	var q FrameQuality
+
+	var mean float64
+	q.Background, q.Noise, mean = backgroundLevel(img)
+	if q.Noise > 0 {
+		q.SNR = mean / q.Noise
+	}
+
+	sm, _ := DetectStars(img, sigma)
+	q.Stars = len(sm.Stars)
+
+	var fwhms, eccentricities []float64
+	for _, s := range sm.Stars[:min(fwhmStars, len(sm.Stars))] {
+		if s.FWHM > 0 {
+			fwhms = append(fwhms, s.FWHM)
+			eccentricities = append(eccentricities, s.Eccentricity)
+		}
+	}
+	q.FWHM = median(fwhms)
+	q.Eccentricity = median(eccentricities)
+
+	return q
+}
+
+// backgroundLevel returns the median, the robust standard deviation and the mean of the luminance.
+func backgroundLevel(img *planar.Image) (float64, float64, float64) {
+	bounds := img.Bounds()
+	step := int(math.Max(1, math.Sqrt(float64(bounds.Dx()*bounds.Dy())/backgroundSamples)))
+
+	var values []float64
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			v := pixelLuminance(img, img.Offset(x, y))
+			values = append(values, v)
+			sum += v
+		}
+	}
+
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
+
+	center := median(values)
+	deviations := make([]float64, len(values))
+	for i := range values {
+		deviations[i] = math.Abs(values[i] - center)
+	}
+
+	return center, median(deviations) * madToSigma, sum / float64(len(values))
+}
+
+// CheckWeighting returns an error if the scheme is not one of the weighting constants.
+func CheckWeighting(scheme string) error {
+	switch scheme {
+	case WeightingNone, WeightingFWHM, WeightingStars, WeightingNoise, WeightingSNR, WeightingCombined:
+		return nil
+	}
+
+	return errors.Errorf("unknown weighting: %q", scheme)
+}
+
+// FrameWeights turns the measured quality of the frames into weights, the best frame weighs 1.
+// If no frame has a weight above zero, they all weigh 1.
+func FrameWeights(qualities []FrameQuality, scheme string) ([]float64, error) {
+	if err := CheckWeighting(scheme); err != nil {
+		return nil, err
+	}
+
+	weights := make([]float64, len(qualities))
+	for i, q := range qualities {
+		switch scheme {
+		case WeightingNone:
+			weights[i] = 1
+		case WeightingFWHM:
+			weights[i] = inverseSquare(q.FWHM)
+		case WeightingStars:
+			weights[i] = float64(q.Stars)
+		case WeightingNoise:
+			weights[i] = inverseSquare(q.Noise)
+		case WeightingSNR:
+			weights[i] = q.SNR * q.SNR
+		case WeightingCombined:
+			weights[i] = float64(q.Stars) * inverseSquare(q.FWHM) * inverseSquare(q.Noise)
+		}
+	}
+
+	best := 0.0
+	for _, w := range weights {
+		best = math.Max(best, w)
+	}
+	if best == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		return weights, nil
+	}
+
+	for i := range weights {
+		weights[i] /= best
+	}
+
+	return weights, nil
+}
+
+func inverseSquare(v float64) float64 {
+	if v <= 0 {
+		return 0
+	}
+
+	return 1 / (v * v)
+}
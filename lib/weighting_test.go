@@ -0,0 +1,76 @@
+package starpack
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestMeasureFrame(t *testing.T) {
+	stars := []syntheticStar{
+		{30.2, 25.6, 1.5, 1.5, 0.5},
+		{70.7, 40.1, 1.5, 1.5, 0.4},
+		{45.4, 75.3, 1.5, 1.5, 0.3},
+	}
+	q := MeasureFrame(starField(image.Rect(0, 0, 100, 100), stars, gaussianProfile), 0)
+
+	fwhm := 1.5 * sigmaToFWHM
+	if q.Stars != len(stars) || math.Abs(q.FWHM-fwhm) > 0.15*fwhm || q.Eccentricity > 0.3 {
+		t.Errorf("expected %d round stars with FWHM %f, got %+v", len(stars), fwhm, q)
+	}
+	if math.Abs(q.Background-0.1) > 0.001 || math.Abs(q.Noise-0.002) > 0.0002 {
+		t.Errorf("expected a background of 0.1 with noise 0.002, got %+v", q)
+	}
+	if q.SNR < 45 || q.SNR > 55 {
+		t.Errorf("expected an SNR around 50, got %f", q.SNR)
+	}
+}
+
+func TestFrameWeights(t *testing.T) {
+	qualities := []FrameQuality{
+		{Stars: 100, FWHM: 2, Noise: 0.01, SNR: 20},
+		{Stars: 50, FWHM: 4, Noise: 0.02, SNR: 10},
+		{Stars: 80, FWHM: 2, Noise: 0.04, SNR: 5},
+	}
+
+	tests := []struct {
+		scheme   string
+		expected []float64
+	}{
+		{WeightingNone, []float64{1, 1, 1}},
+		// The best frame weighs 1, the others relative to it.
+		{WeightingFWHM, []float64{1, 0.25, 1}},
+		{WeightingStars, []float64{1, 0.5, 0.8}},
+		{WeightingNoise, []float64{1, 0.25, 0.0625}},
+		{WeightingSNR, []float64{1, 0.25, 0.0625}},
+		{WeightingCombined, []float64{1, 0.5 * 0.25 * 0.25, 0.8 * 0.0625}},
+	}
+
+	for _, test := range tests {
+		weights, err := FrameWeights(qualities, test.scheme)
+		if err != nil {
+			t.Fatalf("%s: %s", test.scheme, err)
+		}
+		for i := range weights {
+			if math.Abs(weights[i]-test.expected[i]) > 1e-9 {
+				t.Errorf("%s: expected %v, got %v", test.scheme, test.expected, weights)
+				break
+			}
+		}
+	}
+}
+
+func TestFrameWeightsWithoutMeasurements(t *testing.T) {
+	// Frames without stars have nothing to weigh them by, so they all count.
+	weights, err := FrameWeights([]FrameQuality{{}, {}}, WeightingCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[0] != 1 || weights[1] != 1 {
+		t.Errorf("expected equal weights, got %v", weights)
+	}
+
+	if _, err := FrameWeights([]FrameQuality{{}}, "fwmh"); err == nil {
+		t.Error("expected an error for a misspelled weighting")
+	}
+}
@@ -0,0 +1,171 @@
+// Package planar is a float32 image with one slice per channel.
+// Values are nominally in [0, 1], but they are not clamped until the image is converted for display or 16-bit output,
+// so intermediate stages can go negative or above white without losing information.
+package planar
+
+import (
+	"image"
+	"image/color"
+)
+
+// Image has any number of channels: one for mono or CFA data, three for RGB.
+// As a color.Color, images with fewer than three channels are the gray of the first one,
+// and images with more than three are the RGB of the first three.
+type Image struct {
+	Rect image.Rectangle
+	// Channels are stored row by row, the first pixel is at Rect.Min.
+	Channels [][]float32
+	// Alpha is the coverage of each pixel from 0 to 1, like the channels. Nil means every pixel is covered.
+	// Warped frames do not cover their edges, merges weigh the pixels by it.
+	Alpha []float32
+}
+
+// Planar is implemented by images that store their pixels in a planar.Image, including the planar.Image itself.
+type Planar interface {
+	PlanarImage() *Image
+}
+
+func New(r image.Rectangle, channels int) *Image {
+	img := &Image{Rect: r, Channels: make([][]float32, channels)}
+	for ch := range img.Channels {
+		img.Channels[ch] = make([]float32, r.Dx()*r.Dy())
+	}
+
+	return img
+}
+
+// FromImage converts an image, gray images become a single channel.
+// Planar images are returned as they are, without copying.
+func FromImage(src image.Image) *Image {
+	if p, ok := src.(Planar); ok {
+		return p.PlanarImage()
+	}
+
+	bounds := src.Bounds()
+	mono := false
+	switch src.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		mono = true
+	}
+
+	channels := 3
+	if mono {
+		channels = 1
+	}
+	img := New(bounds, channels)
+
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := src.At(x, y).RGBA()
+			img.Channels[0][i] = float32(r) / 0xffff
+			if !mono {
+				img.Channels[1][i] = float32(g) / 0xffff
+				img.Channels[2][i] = float32(b) / 0xffff
+			}
+			i++
+		}
+	}
+
+	return img
+}
+
+func (img *Image) PlanarImage() *Image {
+	return img
+}
+
+func (img *Image) Bounds() image.Rectangle {
+	return img.Rect
+}
+
+func (img *Image) ColorModel() color.Model {
+	if len(img.Channels) < 3 {
+		return color.Gray16Model
+	}
+
+	return color.RGBA64Model
+}
+
+func (img *Image) At(x, y int) color.Color {
+	if !(image.Point{X: x, Y: y}).In(img.Rect) {
+		return color.RGBA64{}
+	}
+
+	r, g, b := img.RGB(img.Offset(x, y))
+	if len(img.Channels) < 3 {
+		return color.Gray16{Y: To16(r)}
+	}
+
+	return color.RGBA64{R: To16(r), G: To16(g), B: To16(b), A: 0xffff}
+}
+
+// Offset is the index of a pixel in the channel slices.
+func (img *Image) Offset(x, y int) int {
+	return (y-img.Rect.Min.Y)*img.Rect.Dx() + x - img.Rect.Min.X
+}
+
+// RGB returns the color at an index, mono images are gray.
+func (img *Image) RGB(i int) (float32, float32, float32) {
+	if len(img.Channels) < 3 {
+		v := img.Channels[0][i]
+		return v, v, v
+	}
+
+	return img.Channels[0][i], img.Channels[1][i], img.Channels[2][i]
+}
+
+// Channel returns a channel, or the last one for images with fewer channels.
+// It lets a mono master frame apply to every channel of a color image.
+func (img *Image) Channel(ch int) []float32 {
+	if ch >= len(img.Channels) {
+		return img.Channels[len(img.Channels)-1]
+	}
+
+	return img.Channels[ch]
+}
+
+func (img *Image) Copy() *Image {
+	output := &Image{Rect: img.Rect, Channels: make([][]float32, len(img.Channels))}
+	for ch := range img.Channels {
+		output.Channels[ch] = make([]float32, len(img.Channels[ch]))
+		copy(output.Channels[ch], img.Channels[ch])
+	}
+	if img.Alpha != nil {
+		output.Alpha = make([]float32, len(img.Alpha))
+		copy(output.Alpha, img.Alpha)
+	}
+
+	return output
+}
+
+// ToImage converts to a 16-bit image, clamping the values.
+func (img *Image) ToImage() image.Image {
+	if len(img.Channels) == 1 {
+		output := image.NewGray16(img.Rect)
+		for i, v := range img.Channels[0] {
+			output.SetGray16(img.Rect.Min.X+i%img.Rect.Dx(), img.Rect.Min.Y+i/img.Rect.Dx(), color.Gray16{Y: To16(v)})
+		}
+		return output
+	}
+
+	output := image.NewRGBA64(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			output.SetRGBA64(x, y, img.At(x, y).(color.RGBA64))
+		}
+	}
+
+	return output
+}
+
+// To16 clamps a value to [0, 1] and scales it to 16 bits.
+func To16(v float32) uint16 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 0xffff
+	}
+
+	return uint16(v*0xffff + 0.5)
+}
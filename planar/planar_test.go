@@ -0,0 +1,59 @@
+package planar
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFromImage(t *testing.T) {
+	src := image.NewRGBA64(image.Rect(2, 3, 4, 5))
+	src.SetRGBA64(3, 4, color.RGBA64{R: 0xffff, G: 0x8000, B: 0, A: 0xffff})
+
+	img := FromImage(src)
+	if len(img.Channels) != 3 || img.Bounds() != src.Bounds() {
+		t.Fatalf("Unexpected geometry: %d channels, %v", len(img.Channels), img.Bounds())
+	}
+
+	r, g, b := img.RGB(img.Offset(3, 4))
+	if r != 1 || g != float32(0x8000)/0xffff || b != 0 {
+		t.Errorf("Unexpected color %f %f %f", r, g, b)
+	}
+	if img.At(3, 4) != src.At(3, 4) {
+		t.Errorf("Expected %v, got %v", src.At(3, 4), img.At(3, 4))
+	}
+	if FromImage(img) != img {
+		t.Errorf("Planar images should not be copied")
+	}
+}
+
+func TestUnclamped(t *testing.T) {
+	img := New(image.Rect(0, 0, 2, 1), 1)
+	img.Channels[0][0] = -0.5
+	img.Channels[0][1] = 1.5
+
+	if img.At(0, 0).(color.Gray16).Y != 0 || img.At(1, 0).(color.Gray16).Y != 0xffff {
+		t.Errorf("Values should only be clamped on output")
+	}
+	if img.Channels[0][0] != -0.5 {
+		t.Errorf("Stored values should not be clamped")
+	}
+}
+
+func TestChannelCounts(t *testing.T) {
+	for channels := 1; channels <= 4; channels++ {
+		img := New(image.Rect(0, 0, 1, 1), channels)
+		for ch := range img.Channels {
+			img.Channels[ch][0] = float32(ch+1) / 4
+		}
+
+		// Fewer than three channels are the gray of the first, more than three the RGB of the first three.
+		var expected color.Color = color.Gray16{Y: To16(0.25)}
+		if channels >= 3 {
+			expected = color.RGBA64{R: To16(0.25), G: To16(0.5), B: To16(0.75), A: 0xffff}
+		}
+		if c := img.At(0, 0); c != expected || img.ColorModel().Convert(c) != c {
+			t.Errorf("%d channels: expected %v, got %v", channels, expected, c)
+		}
+	}
+}
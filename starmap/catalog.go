@@ -0,0 +1,161 @@
+package starmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Catalog formats, also the file extensions of WriteCatalog and ReadCatalog.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+var Formats = []string{FormatJSON, FormatCSV}
+
+// csvColumns are the columns of a CSV catalog, one star per row in the order of the Star fields.
+var csvColumns = []string{"x", "y", "size", "fwhm", "eccentricity", "flux", "peak"}
+
+// csvBounds starts the comment line above the header that holds the bounds of a CSV catalog.
+const csvBounds = "# bounds"
+
+func (s Star) csvRecord() []string {
+	record := make([]string, len(csvColumns))
+	for i, v := range []float64{s.X, s.Y, s.Size, s.FWHM, s.Eccentricity, s.Flux, s.Peak} {
+		record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	return record
+}
+
+// MarshalCSV writes the bounds as a "# bounds minX minY maxX maxY" comment, then a header and a row for every star.
+func (sm Starmap) MarshalCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d %d %d %d\n", csvBounds, sm.Bounds.Min.X, sm.Bounds.Min.Y, sm.Bounds.Max.X, sm.Bounds.Max.Y)
+
+	w := csv.NewWriter(&buf)
+	if err := w.Write(csvColumns); err != nil {
+		return nil, err
+	}
+	for _, s := range sm.Stars {
+		if err := w.Write(s.csvRecord()); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// UnmarshalCSV reads a catalog written by MarshalCSV. Columns are matched by the header, so they may be reordered,
+// and the ones that are missing are left zero.
+func (sm *Starmap) UnmarshalCSV(data []byte) error {
+	r := bufio.NewReader(bytes.NewReader(data))
+	first, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("starmap: reading csv bounds: %v", err)
+	}
+	var bounds image.Rectangle
+	if _, err := fmt.Sscanf(strings.TrimSpace(first), csvBounds+" %d %d %d %d", &bounds.Min.X, &bounds.Min.Y, &bounds.Max.X, &bounds.Max.Y); err != nil {
+		return fmt.Errorf("starmap: reading csv bounds from %q: %v", first, err)
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return fmt.Errorf("starmap: reading csv: %v", err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("starmap: missing csv header")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	stars := make(Stars, 0, len(records)-1)
+	for row, record := range records[1:] {
+		var values [7]float64
+		for i, name := range csvColumns {
+			column, ok := columns[name]
+			if !ok {
+				continue
+			}
+			if values[i], err = strconv.ParseFloat(record[column], 64); err != nil {
+				return fmt.Errorf("starmap: csv row %d, %s: %v", row+1, name, err)
+			}
+		}
+		stars = append(stars, Star{
+			X:            values[0],
+			Y:            values[1],
+			Size:         values[2],
+			FWHM:         values[3],
+			Eccentricity: values[4],
+			Flux:         values[5],
+			Peak:         values[6],
+		})
+	}
+
+	sm.Bounds, sm.Stars = bounds, stars
+	return nil
+}
+
+// MarshalCatalog encodes the starmap in one of the Formats.
+func (sm Starmap) MarshalCatalog(format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(sm, "", "  ")
+	case FormatCSV:
+		return sm.MarshalCSV()
+	}
+
+	return nil, fmt.Errorf("starmap: unknown catalog format: %q", format)
+}
+
+// UnmarshalCatalog decodes a starmap encoded by MarshalCatalog.
+func UnmarshalCatalog(data []byte, format string) (Starmap, error) {
+	var sm Starmap
+	switch format {
+	case FormatJSON:
+		err := json.Unmarshal(data, &sm)
+		return sm, err
+	case FormatCSV:
+		err := sm.UnmarshalCSV(data)
+		return sm, err
+	}
+
+	return sm, fmt.Errorf("starmap: unknown catalog format: %q", format)
+}
+
+// catalogFormat is the format of a catalog file from its extension.
+func catalogFormat(filename string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+}
+
+// WriteCatalog saves the starmap in the format of the file extension, .json or .csv.
+func (sm Starmap) WriteCatalog(filename string) error {
+	data, err := sm.MarshalCatalog(catalogFormat(filename))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// ReadCatalog loads a starmap saved by WriteCatalog.
+func ReadCatalog(filename string) (Starmap, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Starmap{}, err
+	}
+
+	return UnmarshalCatalog(data, catalogFormat(filename))
+}
@@ -1,8 +1,153 @@
 package starmap
 
-// OffsetConfig is the description on how to rotate/translate the stars
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Models of the transformation between frames, from the fewest degrees of freedom to the most.
+const (
+	ModelTranslation = "translation"
+	// ModelSimilarity is rotation, uniform scale and translation.
+	ModelSimilarity = "similarity"
+	ModelAffine     = "affine"
+	ModelHomography = "homography"
+	// ModelAuto picks the simplest model that fits the stars about as well as the more complex ones.
+	ModelAuto = "auto"
+)
+
+// Models lists the models in the order of their degrees of freedom.
+var Models = []string{ModelTranslation, ModelSimilarity, ModelAffine, ModelHomography}
+
+// CheckModel returns an error unless the model is one of Models or ModelAuto.
+func CheckModel(model string) error {
+	if model == ModelAuto {
+		return nil
+	}
+	for _, m := range Models {
+		if m == model {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("starmap: unknown model: %q", model)
+}
+
+// Matrix transforms homogeneous 2D coordinates, row by row.
+type Matrix [9]float64
+
+func Identity() Matrix {
+	return Matrix{1, 0, 0, 0, 1, 0, 0, 0, 1}
+}
+
+func Translation(x, y float64) Matrix {
+	return Matrix{1, 0, x, 0, 1, y, 0, 0, 1}
+}
+
+// Rotation is a clockwise rotation in degrees around cx, cy. The y axis points down, like in images.
+func Rotation(degrees, cx, cy float64) Matrix {
+	angle := degrees * math.Pi / 180.0
+	cosAngle, sinAngle := math.Cos(angle), math.Sin(angle)
+
+	return Translation(cx, cy).Mul(Matrix{cosAngle, -sinAngle, 0, sinAngle, cosAngle, 0, 0, 0, 1}).Mul(Translation(-cx, -cy))
+}
+
+// Apply transforms a point.
+func (m Matrix) Apply(x, y float64) (float64, float64) {
+	w := m[6]*x + m[7]*y + m[8]
+
+	return (m[0]*x + m[1]*y + m[2]) / w, (m[3]*x + m[4]*y + m[5]) / w
+}
+
+// Mul is the transformation of n followed by m.
+func (m Matrix) Mul(n Matrix) Matrix {
+	var out Matrix
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				out[row*3+col] += m[row*3+k] * n[k*3+col]
+			}
+		}
+	}
+
+	return out
+}
+
+// Inverse returns false for singular matrices.
+func (m Matrix) Inverse() (Matrix, bool) {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	if math.Abs(det) < 1e-12 {
+		return Matrix{}, false
+	}
+
+	return Matrix{
+		(m[4]*m[8] - m[5]*m[7]) / det, (m[2]*m[7] - m[1]*m[8]) / det, (m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det, (m[0]*m[8] - m[2]*m[6]) / det, (m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det, (m[1]*m[6] - m[0]*m[7]) / det, (m[0]*m[4] - m[1]*m[3]) / det,
+	}, true
+}
+
+// OffsetConfig is the transformation of a frame onto the reference frame.
+// The zero value is the identity.
 type OffsetConfig struct {
-	Rotation float64
-	X        int
-	Y        int
+	// Matrix maps the coordinates of the frame onto the reference.
+	Matrix Matrix
+	// Model the matrix was fitted with, empty if it was not fitted to matched stars.
+	Model string
+	// Matches is the number of star pairs the matrix was fitted to.
+	Matches int
+	// Residual is the root mean square distance in pixels between the matched stars after the transformation.
+	Residual float64
+}
+
+// NewOffsetConfig translates by x, y, then rotates clockwise in degrees around the center of the bounds.
+// It is the same transformation as Starmap.Offset followed by Starmap.Rotate.
+func NewOffsetConfig(x, y, rotation float64, bounds image.Rectangle) OffsetConfig {
+	center := Rotation(rotation, float64(bounds.Max.X)/2.0, float64(bounds.Max.Y)/2.0)
+
+	return OffsetConfig{Matrix: center.Mul(Translation(x, y))}
+}
+
+// Transformation is the matrix from the frame onto the reference, the zero config is the identity.
+func (c OffsetConfig) Transformation() Matrix {
+	if c.Matrix == (Matrix{}) {
+		return Identity()
+	}
+
+	return c.Matrix
+}
+
+// Project maps a point of a frame onto the reference frame.
+func (c OffsetConfig) Project(x, y float64) (float64, float64) {
+	return c.Transformation().Apply(x, y)
+}
+
+// Inverse maps a point of the reference frame back onto the frame.
+func (c OffsetConfig) Inverse() (Matrix, bool) {
+	return c.Transformation().Inverse()
+}
+
+// Scale is how much the frame is magnified on the reference, ignoring perspective.
+func (c OffsetConfig) Scale() float64 {
+	m := c.Transformation()
+
+	return math.Sqrt(math.Abs(m[0]*m[4] - m[1]*m[3]))
+}
+
+// Rotation is the clockwise rotation in degrees, ignoring shear and perspective.
+func (c OffsetConfig) Rotation() float64 {
+	m := c.Transformation()
+
+	return math.Atan2(m[3]-m[1], m[0]+m[4]) * 180.0 / math.Pi
+}
+
+func (c OffsetConfig) String() string {
+	m := c.Transformation()
+	s := fmt.Sprintf("x=%.2f y=%.2f rotation=%.2f scale=%.4f", m[2], m[5], c.Rotation(), c.Scale())
+	if c.Model != "" {
+		s = fmt.Sprintf("%s %s, %d stars, rms %.2fpx", c.Model, s, c.Matches, c.Residual)
+	}
+
+	return s
 }
@@ -0,0 +1,106 @@
+package starmap
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+const (
+	// Residuals are sub-pixel, their vectors are drawn this many times longer.
+	ResidualScale = 20.0
+	// Circles are at least this big, so unmeasured and tiny stars stay visible.
+	minOverlayRadius = 3.0
+	// Stars rounder than goodEccentricity and within goodFWHM times the median FWHM are fully good,
+	// badEccentricity and badFWHM times the median are fully bad.
+	goodEccentricity = 0.3
+	badEccentricity  = 0.7
+	goodFWHM         = 1.2
+	badFWHM          = 2.0
+)
+
+var (
+	unmeasuredColor = color.NRGBA{R: 0, G: 160, B: 255, A: 255}
+	residualColor   = color.NRGBA{R: 255, G: 0, B: 255, A: 255}
+)
+
+// Overlay draws the stars over the frame they were detected on, as circles with the FWHM as radius.
+// The color goes from green for round stars of the typical FWHM to red for elongated or bloated ones,
+// unmeasured stars are blue. The residual of each pair, found with config, is drawn from its frame star
+// as a magenta line ResidualScale times longer.
+func (sm Starmap) Overlay(background image.Image, pairs []Pair, config OffsetConfig) *image.NRGBA {
+	img := image.NewNRGBA(background.Bounds())
+	draw.Draw(img, img.Bounds(), background, background.Bounds().Min, draw.Src)
+
+	var fwhms []float64
+	for _, s := range sm.Stars {
+		if s.FWHM > 0 {
+			fwhms = append(fwhms, s.FWHM)
+		}
+	}
+	sort.Float64s(fwhms)
+	var medianFWHM float64
+	if len(fwhms) > 0 {
+		medianFWHM = fwhms[len(fwhms)/2]
+	}
+
+	for _, s := range sm.Stars {
+		c := unmeasuredColor
+		radius := math.Sqrt(s.Size / math.Pi)
+		if s.FWHM > 0 {
+			c = qualityColor(s.quality(medianFWHM))
+			radius = s.FWHM
+		}
+		drawCircle(img, s.X, s.Y, math.Max(radius, minOverlayRadius), c)
+	}
+
+	if inverse, ok := config.Inverse(); ok {
+		for _, p := range pairs {
+			x, y := config.Project(p.Frame.X, p.Frame.Y)
+			endX, endY := inverse.Apply(x+ResidualScale*p.DX, y+ResidualScale*p.DY)
+			drawLine(img, p.Frame.X, p.Frame.Y, endX, endY, residualColor)
+		}
+	}
+
+	return img
+}
+
+// quality is 1 for a round star of the median FWHM, and falls to 0 as it gets elongated or bloated.
+func (s Star) quality(medianFWHM float64) float64 {
+	q := 1 - (s.Eccentricity-goodEccentricity)/(badEccentricity-goodEccentricity)
+	if medianFWHM > 0 {
+		q = math.Min(q, 1-(s.FWHM/medianFWHM-goodFWHM)/(badFWHM-goodFWHM))
+	}
+
+	return math.Min(math.Max(q, 0), 1)
+}
+
+// qualityColor goes from red through yellow to green as q goes from 0 to 1.
+func qualityColor(q float64) color.NRGBA {
+	return color.NRGBA{
+		R: uint8(255 * math.Min(2*(1-q), 1)),
+		G: uint8(255 * math.Min(2*q, 1)),
+		A: 255,
+	}
+}
+
+// drawCircle draws the outline of a circle, one pixel wide.
+func drawCircle(img *image.NRGBA, cx, cy, radius float64, c color.NRGBA) {
+	// Enough steps for neighbouring points to be a pixel apart.
+	steps := int(math.Ceil(2*math.Pi*radius)) + 1
+	for i := 0; i < steps; i++ {
+		a := 2 * math.Pi * float64(i) / float64(steps)
+		img.SetNRGBA(int(math.Round(cx+radius*math.Cos(a))), int(math.Round(cy+radius*math.Sin(a))), c)
+	}
+}
+
+// drawLine draws a line one pixel wide, at least one pixel long.
+func drawLine(img *image.NRGBA, x0, y0, x1, y1 float64, c color.NRGBA) {
+	steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		img.SetNRGBA(int(math.Round(x0+t*(x1-x0))), int(math.Round(y0+t*(y1-y0))), c)
+	}
+}
@@ -0,0 +1,282 @@
+package starmap
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	// Number of random minimal samples tried for each model.
+	ransacIterations = 500
+	// A model with more degrees of freedom is only picked over a simpler one if it has this many times more inliers,
+	modelInlierGain = 1.05
+	// or as many inliers with a standard error smaller by this factor and by minResidualGain pixels.
+	modelResidualGain = 0.8
+	minResidualGain   = 0.05
+)
+
+// correspondence is the position of a star on the frame and on the reference.
+type correspondence struct {
+	frameX, frameY         float64
+	referenceX, referenceY float64
+}
+
+// fit is a transformation fitted to a set of correspondences.
+type fit struct {
+	model    string
+	matrix   Matrix
+	inliers  []int
+	residual float64
+}
+
+// standardError is the residual corrected for the degrees of freedom of the model,
+// a model with more parameters always fits the same stars a little closer.
+func (f fit) standardError() float64 {
+	n, k := 2*len(f.inliers), 2*minSamples(f.model)
+	if n <= k {
+		return math.Inf(1)
+	}
+
+	return f.residual * math.Sqrt(float64(n)/float64(n-k))
+}
+
+// minSamples is the number of correspondences that determine the model.
+func minSamples(model string) int {
+	switch model {
+	case ModelTranslation:
+		return 1
+	case ModelSimilarity:
+		return 2
+	case ModelAffine:
+		return 3
+	}
+
+	return 4
+}
+
+// fitModels fits the model to the correspondences with RANSAC.
+// ModelAuto fits every model and picks the simplest one that fits about as well as the more complex ones.
+func fitModels(model string, matches []correspondence) (fit, bool) {
+	if model != ModelAuto {
+		return ransac(model, matches)
+	}
+
+	var best fit
+	found := false
+	for _, m := range Models {
+		candidate, ok := ransac(m, matches)
+		if !ok {
+			continue
+		}
+
+		candidateError, bestError := candidate.standardError(), best.standardError()
+		if !found ||
+			float64(len(candidate.inliers)) > modelInlierGain*float64(len(best.inliers)) ||
+			len(candidate.inliers) >= len(best.inliers) &&
+				candidateError < modelResidualGain*bestError && bestError-candidateError > minResidualGain {
+			best, found = candidate, true
+		}
+	}
+
+	return best, found
+}
+
+// ransac fits the model to random minimal samples of the correspondences, keeps the one that most correspondences
+// agree with, and refits it to all of them.
+func ransac(model string, matches []correspondence) (fit, bool) {
+	samples := minSamples(model)
+	if len(matches) < samples {
+		return fit{}, false
+	}
+
+	// Seeded, so the same frames are always aligned the same way.
+	r := rand.New(rand.NewSource(1))
+
+	var best fit
+	sample := make([]correspondence, samples)
+	for i := 0; i < ransacIterations; i++ {
+		for j, k := range r.Perm(len(matches))[:samples] {
+			sample[j] = matches[k]
+		}
+
+		m, ok := leastSquares(model, sample)
+		if !ok {
+			continue
+		}
+
+		candidate := inliers(model, m, matches)
+		if len(candidate.inliers) > len(best.inliers) ||
+			len(candidate.inliers) == len(best.inliers) && candidate.residual < best.residual {
+			best = candidate
+		}
+		if len(best.inliers) == len(matches) {
+			break
+		}
+	}
+
+	// Refitting can bring in correspondences that the sample missed.
+	for refit := 0; refit < 3 && len(best.inliers) > 0; refit++ {
+		selected := make([]correspondence, len(best.inliers))
+		for i, k := range best.inliers {
+			selected[i] = matches[k]
+		}
+
+		m, ok := leastSquares(model, selected)
+		if !ok {
+			break
+		}
+		candidate := inliers(model, m, matches)
+		if len(candidate.inliers) < len(best.inliers) {
+			break
+		}
+		best = candidate
+	}
+
+	// The minimal sample always fits itself, as many stars again have to agree so a few stars do not overfit it.
+	if len(best.inliers) < minMatches || len(best.inliers) < 2*samples {
+		return fit{}, false
+	}
+
+	return best, true
+}
+
+// inliers collects the correspondences that m projects within matchResidual pixels.
+func inliers(model string, m Matrix, matches []correspondence) fit {
+	f := fit{model: model, matrix: m}
+
+	var sum float64
+	for i, c := range matches {
+		x, y := m.Apply(c.frameX, c.frameY)
+		d := math.Hypot(x-c.referenceX, y-c.referenceY)
+		if d <= matchResidual {
+			f.inliers = append(f.inliers, i)
+			sum += d * d
+		}
+	}
+	if len(f.inliers) > 0 {
+		f.residual = math.Sqrt(sum / float64(len(f.inliers)))
+	}
+
+	return f
+}
+
+// leastSquares fits the model to the correspondences.
+// The points are normalized first (Hartley), so the equations are well conditioned whatever the image size.
+func leastSquares(model string, matches []correspondence) (Matrix, bool) {
+	// The same normalization for both sides keeps every model within its class.
+	var cx, cy float64
+	for _, c := range matches {
+		cx += c.frameX + c.referenceX
+		cy += c.frameY + c.referenceY
+	}
+	n := float64(2 * len(matches))
+	cx, cy = cx/n, cy/n
+
+	var distance float64
+	for _, c := range matches {
+		distance += math.Hypot(c.frameX-cx, c.frameY-cy) + math.Hypot(c.referenceX-cx, c.referenceY-cy)
+	}
+	scale := 1.0
+	if distance > 0 {
+		scale = math.Sqrt2 * n / distance
+	}
+	normalize := Matrix{scale, 0, -scale * cx, 0, scale, -scale * cy, 0, 0, 1}
+
+	var rows [][]float64
+	var values []float64
+	for _, c := range matches {
+		x, y := normalize.Apply(c.frameX, c.frameY)
+		rx, ry := normalize.Apply(c.referenceX, c.referenceY)
+
+		switch model {
+		case ModelTranslation:
+			rows = append(rows, []float64{1, 0}, []float64{0, 1})
+			values = append(values, rx-x, ry-y)
+		case ModelSimilarity:
+			rows = append(rows, []float64{x, -y, 1, 0}, []float64{y, x, 0, 1})
+			values = append(values, rx, ry)
+		case ModelAffine:
+			rows = append(rows, []float64{x, y, 1, 0, 0, 0}, []float64{0, 0, 0, x, y, 1})
+			values = append(values, rx, ry)
+		default:
+			rows = append(rows, []float64{x, y, 1, 0, 0, 0, -x * rx, -y * rx}, []float64{0, 0, 0, x, y, 1, -x * ry, -y * ry})
+			values = append(values, rx, ry)
+		}
+	}
+
+	p, ok := solveNormalEquations(rows, values)
+	if !ok {
+		return Matrix{}, false
+	}
+
+	var m Matrix
+	switch model {
+	case ModelTranslation:
+		m = Translation(p[0], p[1])
+	case ModelSimilarity:
+		m = Matrix{p[0], -p[1], p[2], p[1], p[0], p[3], 0, 0, 1}
+	case ModelAffine:
+		m = Matrix{p[0], p[1], p[2], p[3], p[4], p[5], 0, 0, 1}
+	default:
+		m = Matrix{p[0], p[1], p[2], p[3], p[4], p[5], p[6], p[7], 1}
+	}
+
+	denormalize, _ := normalize.Inverse()
+	m = denormalize.Mul(m).Mul(normalize)
+	if math.Abs(m[8]) < 1e-12 {
+		return Matrix{}, false
+	}
+	for i := range m {
+		m[i] /= m[8]
+	}
+
+	return m, true
+}
+
+// solveNormalEquations solves rows * p = values in the least squares sense, with Gaussian elimination.
+func solveNormalEquations(rows [][]float64, values []float64) ([]float64, bool) {
+	size := len(rows[0])
+	a := make([][]float64, size)
+	for i := range a {
+		a[i] = make([]float64, size+1)
+	}
+	for r, row := range rows {
+		for i := range row {
+			for j := range row {
+				a[i][j] += row[i] * row[j]
+			}
+			a[i][size] += row[i] * values[r]
+		}
+	}
+
+	for col := 0; col < size; col++ {
+		pivot := col
+		for r := col + 1; r < size; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-10 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for r := col + 1; r < size; r++ {
+			factor := a[r][col] / a[col][col]
+			for c := col; c <= size; c++ {
+				a[r][c] -= factor * a[col][c]
+			}
+		}
+	}
+
+	p := make([]float64, size)
+	for r := size - 1; r >= 0; r-- {
+		sum := a[r][size]
+		for c := r + 1; c < size; c++ {
+			sum -= a[r][c] * p[c]
+		}
+		p[r] = sum / a[r][r]
+	}
+
+	return p, true
+}
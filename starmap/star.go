@@ -5,19 +5,41 @@ import (
 )
 
 type Star struct {
-	X    float64
-	Y    float64
-	Size float64
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	Size float64 `json:"size"`
+
+	// Measured on the background subtracted image, zero if the star was not measured.
+	// Full width at half maximum in pixels, the average of the major and minor axes.
+	FWHM float64 `json:"fwhm"`
+	// Eccentricity is 0 for a round star and approaches 1 as it gets elongated.
+	Eccentricity float64 `json:"eccentricity"`
+	// Flux is the total light of the star, Peak is its brightest pixel.
+	Flux float64 `json:"flux"`
+	Peak float64 `json:"peak"`
 }
 
 func (s Star) Copy() Star {
 	return Star{
-		X:    s.X,
-		Y:    s.Y,
-		Size: s.Size,
+		X:            s.X,
+		Y:            s.Y,
+		Size:         s.Size,
+		FWHM:         s.FWHM,
+		Eccentricity: s.Eccentricity,
+		Flux:         s.Flux,
+		Peak:         s.Peak,
 	}
 }
 
+// Brightness orders stars, it is the flux of measured stars and the size of the rest.
+func (s Star) Brightness() float64 {
+	if s.Flux > 0 {
+		return s.Flux
+	}
+
+	return s.Size
+}
+
 func (s Star) IntersectWith(x, y float64) bool {
 	xDist := math.Abs(s.X - x)
 	yDist := math.Abs(s.Y - y)
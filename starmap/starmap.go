@@ -44,8 +44,8 @@ func (stars Stars) Center() Star {
 }
 
 type Starmap struct {
-	Bounds image.Rectangle
-	Stars  Stars
+	Bounds image.Rectangle `json:"bounds"`
+	Stars  Stars           `json:"stars"`
 }
 
 func (sm Starmap) Copy() Starmap {
@@ -90,7 +90,10 @@ func (sm Starmap) IntersectWithStar(x, y float64) bool {
 }
 
 func (sm Starmap) WriteFile(filename string) error {
-	f, _ := os.Create(filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	return png.Encode(f, sm.ToImage())
@@ -138,6 +141,17 @@ func (sm Starmap) Rotate(deg float64) Starmap {
 	return sm
 }
 
+// Transform projects every star with the config, see OffsetConfig.Project.
+func (sm Starmap) Transform(config OffsetConfig) Starmap {
+	output := sm.Copy()
+
+	for i := range output.Stars {
+		output.Stars[i].X, output.Stars[i].Y = config.Project(output.Stars[i].X, output.Stars[i].Y)
+	}
+
+	return output
+}
+
 func (sm Starmap) FindOffset(sm2 Starmap) (OffsetConfig, float64) {
 	max := 64
 	m2 := max * max
@@ -169,8 +183,60 @@ func (sm Starmap) FindOffset(sm2 Starmap) (OffsetConfig, float64) {
 		xMotion, yMotion = xMotion+dx, yMotion+dy
 	}
 
-	return OffsetConfig{X: bestX, Y: bestY, Rotation: float64(bestRotation)}, maxCorrectPixels
+	return NewOffsetConfig(float64(bestX), float64(bestY), float64(bestRotation), sm2.Bounds), maxCorrectPixels
+
+}
+
+// Pair is a star of a frame matched to the closest star of the reference after the transformation.
+// DX and DY is the residual on the reference, from the projected frame star to the reference star.
+type Pair struct {
+	Frame, Reference Star
+	DX, DY           float64
+}
+
+// Pairs pairs every star of sm2, projected with config, with the closest star of sm within maxDistance.
+func (sm Starmap) Pairs(sm2 Starmap, config OffsetConfig, maxDistance float64) []Pair {
+	var pairs []Pair
+	for i := range sm2.Stars {
+		x, y := config.Project(sm2.Stars[i].X, sm2.Stars[i].Y)
+
+		closest, best := maxDistance, -1
+		for j := range sm.Stars {
+			if d := math.Hypot(sm.Stars[j].X-x, sm.Stars[j].Y-y); d < closest {
+				closest, best = d, j
+			}
+		}
+
+		if best >= 0 {
+			r := sm.Stars[best]
+			pairs = append(pairs, Pair{Frame: sm2.Stars[i], Reference: r, DX: r.X - x, DY: r.Y - y})
+		}
+	}
+
+	return pairs
+}
+
+// RefineOffset improves an offset found by FindOffset (sm.FindOffset(sm2)) to sub-pixel accuracy.
+// Every star of sm2 is paired with the closest star of sm after the transformation,
+// and the average distance of the pairs is added to the translation.
+func (sm Starmap) RefineOffset(sm2 Starmap, config OffsetConfig, maxDistance float64) OffsetConfig {
+	pairs := sm.Pairs(sm2, config, maxDistance)
+	if len(pairs) == 0 {
+		return config
+	}
+
+	var dx, dy float64
+	for _, p := range pairs {
+		dx += p.DX
+		dy += p.DY
+	}
+	dx /= float64(len(pairs))
+	dy /= float64(len(pairs))
+
+	// The residual is measured on the reference, so the correction comes after the transformation.
+	config.Matrix = Translation(dx, dy).Mul(config.Transformation())
 
+	return config
 }
 
 // Compress several stars into appropriate bigger stars.
@@ -178,28 +244,23 @@ func (sm Starmap) FindOffset(sm2 Starmap) (OffsetConfig, float64) {
 func (sm Starmap) Compress() Starmap {
 	var clusters []Stars
 	var foundCluster bool
-
 	for i := range sm.Stars {
 		foundCluster = false
-
 		for j := range clusters {
 			if !foundCluster && clusters[j].IsCloseTo(sm.Stars[i]) {
 				clusters[j] = append(clusters[j], sm.Stars[i])
 				foundCluster = true
 			}
 		}
-
 		if !foundCluster {
 			clusters = append(clusters, Stars{sm.Stars[i]})
 		}
 	}
-
 	var starmap Starmap
 	starmap.Bounds = sm.Bounds
 	for i := range clusters {
 		starmap.Stars = append(starmap.Stars, clusters[i].Center())
 	}
-
 	return starmap
 }
 
@@ -2,7 +2,10 @@ package starmap
 
 import (
 	"image"
+	"image/color"
 	"image/png"
+	"math"
+	"math/rand"
 	"os"
 	"testing"
 
@@ -173,8 +176,7 @@ func TestOffsetPartial(t *testing.T) {
 	defer f1.Close()
 	png.Encode(f1, diff)
 
-	m2 = m2.Offset(float64(offset.X), float64(offset.Y))
-	m2 = m2.Rotate(offset.Rotation)
+	m2 = m2.Transform(offset)
 	sm = Starmaps{m1, m2}
 	afterPixels := sm.CorrectPixels()
 
@@ -207,8 +209,7 @@ func TestRotation(t *testing.T) {
 	beforePixels := sm.CorrectPixels()
 
 	offset, _ := m1.FindOffset(m2)
-	m2 = m2.Offset(float64(offset.X), float64(offset.Y))
-	m2 = m2.Rotate(offset.Rotation)
+	m2 = m2.Transform(offset)
 
 	sm = Starmaps{m1, m2}
 	afterPixels := sm.CorrectPixels()
@@ -216,3 +217,207 @@ func TestRotation(t *testing.T) {
 		t.Errorf("Alignment should improve correct pixels: %f -> %f\n", beforePixels, afterPixels)
 	}
 }
+
+func TestProjectMatchesStarmap(t *testing.T) {
+	bounds := image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: 20, Y: 20}}
+	m := Starmap{Bounds: bounds, Stars: Stars{{X: 3, Y: 7, Size: 1}}}
+	config := NewOffsetConfig(2, -1, 30, bounds)
+
+	expected := m.Offset(2, -1).Rotate(30).Stars[0]
+	x, y := config.Project(3, 7)
+	if math.Abs(x-expected.X) > 1e-9 || math.Abs(y-expected.Y) > 1e-9 {
+		t.Errorf("Expected %f,%f got %f,%f", expected.X, expected.Y, x, y)
+	}
+}
+
+func TestRefineOffset(t *testing.T) {
+	bounds := image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: 100, Y: 100}}
+	ref := Starmap{Bounds: bounds, Stars: Stars{{X: 10, Y: 20, Size: 2}, {X: 60, Y: 30, Size: 2}, {X: 40, Y: 80, Size: 2}}}
+	target := ref.Offset(-3.4, 1.25)
+
+	config := ref.RefineOffset(target, NewOffsetConfig(3, -1, 0, bounds), 3)
+	x, y := config.Project(0, 0)
+	if math.Abs(x-3.4) > 1e-9 || math.Abs(y+1.25) > 1e-9 {
+		t.Errorf("Expected 3.4,-1.25 got %f,%f", x, y)
+	}
+}
+
+// transformedStarmap projects the stars of a frame onto the reference with config,
+// dropping some stars and adding others that are only on the reference.
+func transformedStarmap(frame Starmap, config OffsetConfig, r *rand.Rand) Starmap {
+	reference := Starmap{Bounds: frame.Bounds}
+	for i, s := range frame.Stars {
+		if i%7 == 3 {
+			continue
+		}
+		x, y := config.Project(s.X, s.Y)
+		reference.Stars = append(reference.Stars, Star{X: x + r.Float64()*0.2 - 0.1, Y: y + r.Float64()*0.2 - 0.1, Size: s.Size})
+	}
+	for i := 0; i < 4; i++ {
+		reference.Stars = append(reference.Stars, Star{X: r.Float64() * 400, Y: r.Float64() * 300, Size: 1 + r.Float64()*4})
+	}
+
+	return reference
+}
+
+func TestMatchTriangles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	bounds := image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: 400, Y: 300}}
+	frame := Starmap{Bounds: bounds}
+	for i := 0; i < 25; i++ {
+		frame.Stars = append(frame.Stars, Star{X: r.Float64() * 400, Y: r.Float64() * 300, Size: 1 + r.Float64()*4})
+	}
+
+	tests := []struct {
+		name   string
+		config OffsetConfig
+		model  string
+	}{
+		{"translation", NewOffsetConfig(120, -75, 0, bounds), ModelTranslation},
+		{"rotation", NewOffsetConfig(-40.7, 13, 37.5, bounds), ModelSimilarity},
+		{"meridian flip", NewOffsetConfig(7, 2, 180, bounds), ModelSimilarity},
+		{"refocused", OffsetConfig{Matrix: Rotation(-12, 200, 150).Mul(Matrix{0.92, 0, 30, 0, 0.92, -20, 0, 0, 1})}, ModelSimilarity},
+		{"reducer", OffsetConfig{Matrix: Rotation(5, 200, 150).Mul(Matrix{0.8, 0, 40, 0, 0.8, 30, 0, 0, 1})}, ModelSimilarity},
+		{"strong reducer", OffsetConfig{Matrix: Matrix{0.63, 0, 70, 0, 0.63, 55, 0, 0, 1}}, ModelSimilarity},
+		{"barlow", OffsetConfig{Matrix: Matrix{1.6, 0, -120, 0, 1.6, -90, 0, 0, 1}}, ModelSimilarity},
+		{"shear", OffsetConfig{Matrix: Matrix{1.004, 0.012, -10, -0.003, 0.996, 8, 0, 0, 1}}, ModelAffine},
+		{"perspective", OffsetConfig{Matrix: Matrix{1, 0.002, 5, -0.001, 1, 3, 3e-5, -2e-5, 1}}, ModelHomography},
+	}
+
+	for _, test := range tests {
+		reference := transformedStarmap(frame, test.config, r)
+		found, err := reference.MatchTriangles(frame, ModelAuto)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if found.Matches < 10 {
+			t.Errorf("%s: only %d stars matched", test.name, found.Matches)
+		}
+		if found.Model != test.model {
+			t.Errorf("%s: expected %s model, got %s", test.name, test.model, found)
+		}
+		if found.Residual > 0.2 {
+			t.Errorf("%s: residual %f", test.name, found.Residual)
+		}
+
+		for _, s := range frame.Stars {
+			ex, ey := test.config.Project(s.X, s.Y)
+			x, y := found.Project(s.X, s.Y)
+			if math.Hypot(ex-x, ey-y) > 0.5 {
+				t.Fatalf("%s: found %s, star at %f,%f projected to %f,%f", test.name, found, ex, ey, x, y)
+			}
+		}
+	}
+}
+
+func TestRansacRejectsOutliers(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	m := Matrix{0.98, -0.05, 12, 0.04, 1.01, -7, 1e-5, 2e-5, 1}
+
+	var matches []correspondence
+	for i := 0; i < 30; i++ {
+		x, y := r.Float64()*1000, r.Float64()*800
+		rx, ry := m.Apply(x, y)
+		if i%4 == 0 {
+			// Mismatched star.
+			rx, ry = r.Float64()*1000, r.Float64()*800
+		}
+		matches = append(matches, correspondence{frameX: x, frameY: y, referenceX: rx, referenceY: ry})
+	}
+
+	for _, model := range []string{ModelHomography, ModelAuto} {
+		f, ok := fitModels(model, matches)
+		if !ok {
+			t.Fatalf("%s: no fit", model)
+		}
+		if f.model != ModelHomography || len(f.inliers) < 22 || f.residual > 1e-6 {
+			t.Errorf("%s: got %s model with %d inliers, residual %f", model, f.model, len(f.inliers), f.residual)
+		}
+	}
+}
+
+func TestMatchTrianglesNoMatch(t *testing.T) {
+	bounds := image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: 100, Y: 100}}
+	sm := Starmap{Bounds: bounds, Stars: Stars{{X: 10, Y: 10, Size: 1}, {X: 50, Y: 20, Size: 1}}}
+	if _, err := sm.MatchTriangles(sm, ModelAuto); err != ErrNoMatch {
+		t.Errorf("Expected ErrNoMatch, got %v", err)
+	}
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	sm := Starmap{
+		Bounds: image.Rect(-4, 2, 640, 480),
+		Stars: Stars{
+			{X: 12.25, Y: 40.5, Size: 9, FWHM: 2.7, Eccentricity: 0.31, Flux: 12.125, Peak: 0.8},
+			{X: 1e-7, Y: 300.0625, Size: 1},
+		},
+	}
+
+	for _, format := range Formats {
+		data, err := sm.MarshalCatalog(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		decoded, err := UnmarshalCatalog(data, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if decoded.Bounds != sm.Bounds || len(decoded.Stars) != len(sm.Stars) {
+			t.Fatalf("%s: expected %+v, got %+v", format, sm, decoded)
+		}
+		for i := range sm.Stars {
+			if decoded.Stars[i] != sm.Stars[i] {
+				t.Errorf("%s: star %d expected %+v, got %+v", format, i, sm.Stars[i], decoded.Stars[i])
+			}
+		}
+	}
+
+	// Columns are read by name, missing ones are zero.
+	decoded, err := UnmarshalCatalog([]byte("# bounds 0 0 10 10\npeak,y,x\n0.5,2,3\n"), FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Stars) != 1 || decoded.Stars[0] != (Star{X: 3, Y: 2, Peak: 0.5}) {
+		t.Errorf("Unexpected stars %+v", decoded.Stars)
+	}
+
+	if _, err := sm.MarshalCatalog("xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	bounds := image.Rect(0, 0, 40, 30)
+	reference := Starmap{Bounds: bounds, Stars: Stars{{X: 12.5, Y: 10, Size: 9, FWHM: 3}, {X: 32, Y: 20, Size: 4}}}
+	frame := Starmap{Bounds: bounds, Stars: Stars{{X: 10, Y: 10, Size: 9, FWHM: 3}, {X: 30, Y: 20, Size: 4}}}
+	config := OffsetConfig{Matrix: Translation(2, 0)}
+
+	pairs := reference.Pairs(frame, config, 3)
+	if len(pairs) != 2 || pairs[0].DX != 0.5 || pairs[0].DY != 0 || pairs[1].DX != 0 {
+		t.Fatalf("Unexpected pairs %+v", pairs)
+	}
+
+	img := frame.Overlay(image.NewGray(bounds), pairs, config)
+	if c := img.NRGBAAt(10, 13); c != qualityColor(1) {
+		t.Errorf("Expected a green circle for a round star, got %v", c)
+	}
+	if c := img.NRGBAAt(30, 23); c != unmeasuredColor {
+		t.Errorf("Expected a blue circle for an unmeasured star, got %v", c)
+	}
+	// The residual of half a pixel is drawn ResidualScale times longer.
+	for _, x := range []int{11, 15, 20} {
+		if c := img.NRGBAAt(x, 10); c != residualColor {
+			t.Errorf("Expected the residual at %d,10, got %v", x, c)
+		}
+	}
+	if c := img.NRGBAAt(22, 10); c != (color.NRGBA{A: 255}) {
+		t.Errorf("Expected the background past the residual, got %v", c)
+	}
+}
+
+func TestMatchTrianglesUnknownModel(t *testing.T) {
+	sm := Starmap{Bounds: image.Rect(0, 0, 100, 100), Stars: Stars{{X: 10, Y: 10, Size: 1}, {X: 50, Y: 20, Size: 1}, {X: 30, Y: 70, Size: 1}}}
+	if _, err := sm.MatchTriangles(sm, "similar"); err == nil || err == ErrNoMatch {
+		t.Errorf("Expected an unknown model error, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package starmap
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	// Number of the brightest stars that triangles are built from.
+	triangleStars = 20
+	// Maximum difference of the side ratios of matching triangles.
+	triangleTolerance = 0.01
+	// Width of the bins of the logarithm of the scale that matching triangles vote for. The frames may be taken
+	// with any focal reducer, but the true matches agree on a scale and the false ones scatter.
+	triangleScaleBin = 0.02
+	// Triangles with a shorter longest side, or with nearly equal sides, give unreliable vertex order.
+	minTriangleSide     = 5.0
+	minTriangleRatioGap = 0.02
+	// Maximum distance in pixels between a projected star and its pair after the transform is solved.
+	matchResidual = 3.0
+	minMatches    = 3
+)
+
+// ErrNoMatch is returned when the starmaps do not share enough triangles to be aligned.
+var ErrNoMatch = errors.New("starmap: not enough matching stars")
+
+// triangle of stars, invariant to translation, rotation and scale.
+type triangle struct {
+	// Vertices ordered by the length of the opposite side, shortest first.
+	vertices [3]int
+	// Shortest and middle side over the longest side.
+	ratio0, ratio1 float64
+	longest        float64
+	// Clockwise or counter-clockwise, a rotation keeps it but a mirror image flips it.
+	clockwise bool
+}
+
+// brightest returns the indices of the brightest stars.
+func (sm Starmap) brightest(n int) []int {
+	indices := make([]int, len(sm.Stars))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return sm.Stars[indices[i]].Brightness() > sm.Stars[indices[j]].Brightness()
+	})
+
+	if len(indices) > n {
+		indices = indices[:n]
+	}
+
+	return indices
+}
+
+// triangles builds every usable triangle from the brightest stars, sorted by ratio0.
+func (sm Starmap) triangles() []triangle {
+	stars := sm.brightest(triangleStars)
+
+	var triangles []triangle
+	for i := 0; i < len(stars); i++ {
+		for j := i + 1; j < len(stars); j++ {
+			for k := j + 1; k < len(stars); k++ {
+				if t, ok := sm.newTriangle(stars[i], stars[j], stars[k]); ok {
+					triangles = append(triangles, t)
+				}
+			}
+		}
+	}
+
+	sort.Slice(triangles, func(i, j int) bool {
+		return triangles[i].ratio0 < triangles[j].ratio0
+	})
+
+	return triangles
+}
+
+func (sm Starmap) newTriangle(a, b, c int) (triangle, bool) {
+	vertices := [3]int{a, b, c}
+	var sides [3]float64
+	for v := range vertices {
+		// The side opposite of the vertex.
+		p, q := sm.Stars[vertices[(v+1)%3]], sm.Stars[vertices[(v+2)%3]]
+		sides[v] = math.Hypot(p.X-q.X, p.Y-q.Y)
+	}
+
+	order := []int{0, 1, 2}
+	sort.Slice(order, func(i, j int) bool {
+		return sides[order[i]] < sides[order[j]]
+	})
+
+	t := triangle{longest: sides[order[2]]}
+	if t.longest < minTriangleSide {
+		return t, false
+	}
+	t.ratio0 = sides[order[0]] / t.longest
+	t.ratio1 = sides[order[1]] / t.longest
+	if t.ratio1-t.ratio0 < minTriangleRatioGap || 1-t.ratio1 < minTriangleRatioGap {
+		return t, false
+	}
+
+	for v := range order {
+		t.vertices[v] = vertices[order[v]]
+	}
+
+	p0, p1, p2 := sm.Stars[t.vertices[0]], sm.Stars[t.vertices[1]], sm.Stars[t.vertices[2]]
+	t.clockwise = (p1.X-p0.X)*(p2.Y-p0.Y)-(p1.Y-p0.Y)*(p2.X-p0.X) > 0
+
+	return t, true
+}
+
+// starPair is a star of the frame (sm2) and the star of the reference (sm) it corresponds to.
+type starPair struct {
+	reference, frame int
+	votes            int
+}
+
+// matchStars pairs the stars of sm2 with the stars of sm that are vertices of similar triangles.
+func (sm Starmap) matchStars(sm2 Starmap) []starPair {
+	referenceTriangles := sm.triangles()
+	frameTriangles := sm2.triangles()
+
+	votes := make([][]int, len(sm.Stars))
+	for i := range votes {
+		votes[i] = make([]int, len(sm2.Stars))
+	}
+
+	type similar struct {
+		reference, frame triangle
+		scale            int
+	}
+	var matches []similar
+	scales := make(map[int]int)
+	for _, t := range frameTriangles {
+		first := sort.Search(len(referenceTriangles), func(i int) bool {
+			return referenceTriangles[i].ratio0 >= t.ratio0-triangleTolerance
+		})
+		for i := first; i < len(referenceTriangles) && referenceTriangles[i].ratio0 <= t.ratio0+triangleTolerance; i++ {
+			r := referenceTriangles[i]
+			if math.Abs(r.ratio1-t.ratio1) > triangleTolerance || r.clockwise != t.clockwise {
+				continue
+			}
+
+			scale := int(math.Floor(math.Log(r.longest/t.longest) / triangleScaleBin))
+			matches = append(matches, similar{r, t, scale})
+			scales[scale]++
+		}
+	}
+
+	// Only the triangles of the most common scale, give or take a bin, vote for their vertices.
+	bestScale, bestCount := 0, 0
+	for scale := range scales {
+		count := scales[scale-1] + scales[scale] + scales[scale+1]
+		if count > bestCount || count == bestCount && scale < bestScale {
+			bestScale, bestCount = scale, count
+		}
+	}
+	for _, m := range matches {
+		if m.scale < bestScale-1 || m.scale > bestScale+1 {
+			continue
+		}
+		for v := range m.reference.vertices {
+			votes[m.reference.vertices[v]][m.frame.vertices[v]]++
+		}
+	}
+
+	// Keep the pairs that are each other's best match.
+	var pairs []starPair
+	for i := range votes {
+		best := -1
+		for j := range votes[i] {
+			if votes[i][j] > 0 && (best < 0 || votes[i][j] > votes[i][best]) {
+				best = j
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		mutual := true
+		for k := range votes {
+			if votes[k][best] > votes[i][best] {
+				mutual = false
+				break
+			}
+		}
+		if mutual {
+			pairs = append(pairs, starPair{reference: i, frame: best, votes: votes[i][best]})
+		}
+	}
+
+	return pairs
+}
+
+// MatchTriangles finds the transformation of sm2 onto sm from similar triangles of stars,
+// the same way as FindOffset: projecting the stars of sm2 with the result lands them on sm.
+// The matched stars are fitted with RANSAC to the model, one of Models or ModelAuto.
+// It works for any translation, rotation and scale, including the 180 degree turn of a meridian flip.
+func (sm Starmap) MatchTriangles(sm2 Starmap, model string) (OffsetConfig, error) {
+	if err := CheckModel(model); err != nil {
+		return OffsetConfig{}, err
+	}
+
+	pairs := sm.matchStars(sm2)
+
+	matches := make([]correspondence, len(pairs))
+	for i, p := range pairs {
+		s, r := sm2.Stars[p.frame], sm.Stars[p.reference]
+		matches[i] = correspondence{frameX: s.X, frameY: s.Y, referenceX: r.X, referenceY: r.Y}
+	}
+
+	f, ok := fitModels(model, matches)
+	if !ok {
+		return OffsetConfig{}, ErrNoMatch
+	}
+
+	return OffsetConfig{Matrix: f.matrix, Model: f.model, Matches: len(f.inliers), Residual: f.residual}, nil
+}
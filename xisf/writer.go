@@ -0,0 +1,93 @@
+// Package xisf writes images in PixInsight's Extensible Image Serialization Format.
+// See https://pixinsight.com/doc/docs/XISF-1.0-spec/XISF-1.0-spec.html
+package xisf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/Coornail/starpack/fits"
+	"github.com/Coornail/starpack/planar"
+)
+
+const signature = "XISF0100"
+
+// Encode writes img as a monolithic XISF file with 32-bit float planar data in [0, 1].
+// Keywords from h are embedded as FITS keywords, which PixInsight shows in its header view.
+func Encode(w io.Writer, img image.Image, h fits.Header) error {
+	bounds := img.Bounds()
+	planes := planar.FromImage(img).Channels
+	dataSize := len(planes) * bounds.Dx() * bounds.Dy() * 4
+
+	// Channels past those of the color space are extra channels to XISF.
+	colorSpace := "RGB"
+	if len(planes) < 3 {
+		colorSpace = "Gray"
+	}
+
+	// The header has to contain the absolute position of the data that follows it,
+	// iterate until the length of the position no longer changes the header length.
+	var header string
+	position := 0
+	for {
+		header = xmlHeader(bounds, len(planes), colorSpace, position, dataSize, h)
+		next := len(signature) + 8 + len(header)
+		if next == position {
+			break
+		}
+		position = next
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(signature)
+	lengths := make([]byte, 8)
+	binary.LittleEndian.PutUint32(lengths, uint32(len(header)))
+	bw.Write(lengths)
+	bw.WriteString(header)
+
+	buf := make([]byte, 4)
+	for _, plane := range planes {
+		for _, v := range plane {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(v))
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+func xmlHeader(bounds image.Rectangle, channels int, colorSpace string, position, size int, h fits.Header) string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	sb.WriteString(`<xisf version="1.0" xmlns="http://www.pixinsight.com/xisf">` + "\n")
+	fmt.Fprintf(&sb, `<Image geometry="%d:%d:%d" sampleFormat="Float32" bounds="0:1" colorSpace="%s" location="attachment:%d:%d">`+"\n",
+		bounds.Dx(), bounds.Dy(), channels, colorSpace, position, size)
+
+	for _, c := range h.Cards {
+		if c.Key == "HISTORY" || c.Key == "COMMENT" {
+			// Commentary keywords keep their text in the comment attribute.
+			c.Comment, c.Value = c.Value, ""
+		}
+		fmt.Fprintf(&sb, `<FITSKeyword name="%s" value="%s" comment="%s"/>`+"\n", escape(c.Key), escape(c.Value), escape(c.Comment))
+	}
+
+	sb.WriteString("</Image>\n")
+	sb.WriteString(`<Metadata><Property id="XISF:CreatorApplication" type="String">starpack</Property></Metadata>` + "\n")
+	sb.WriteString("</xisf>")
+
+	return sb.String()
+}
+
+func escape(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
@@ -0,0 +1,86 @@
+package xisf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/Coornail/starpack/fits"
+	"github.com/Coornail/starpack/planar"
+)
+
+type testHeader struct {
+	Image struct {
+		Geometry   string `xml:"geometry,attr"`
+		ColorSpace string `xml:"colorSpace,attr"`
+		Location   string `xml:"location,attr"`
+		Keywords   []struct {
+			Name    string `xml:"name,attr"`
+			Value   string `xml:"value,attr"`
+			Comment string `xml:"comment,attr"`
+		} `xml:"FITSKeyword"`
+	}
+}
+
+func TestEncode(t *testing.T) {
+	img := planar.New(image.Rect(0, 0, 3, 2), 3)
+	for ch := range img.Channels {
+		for i := range img.Channels[ch] {
+			img.Channels[ch][i] = float32(ch*10+i) / 100
+		}
+	}
+
+	var h fits.Header
+	h.SetString("OBJECT", `M31 "Andromeda" & <friends>`, "")
+	h.AddHistory("stacked with starpack")
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, h); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	if string(file[:8]) != signature {
+		t.Fatalf("expected the %s signature, got %q", signature, file[:8])
+	}
+	headerLength := int(binary.LittleEndian.Uint32(file[8:12]))
+	if reserved := binary.LittleEndian.Uint32(file[12:16]); reserved != 0 {
+		t.Errorf("expected the reserved field to be zero, got %d", reserved)
+	}
+
+	var header testHeader
+	if err := xml.Unmarshal(file[16:16+headerLength], &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Image.Geometry != "3:2:3" || header.Image.ColorSpace != "RGB" {
+		t.Errorf("expected a 3x2 RGB image, got %+v", header.Image)
+	}
+
+	var position, size int
+	if _, err := fmt.Sscanf(header.Image.Location, "attachment:%d:%d", &position, &size); err != nil {
+		t.Fatalf("reading location %q: %s", header.Image.Location, err)
+	}
+	if position != 16+headerLength || size != 3*2*3*4 || position+size != len(file) {
+		t.Fatalf("expected the data right after the %d byte header up to the end of the %d byte file, got %s",
+			headerLength, len(file), header.Image.Location)
+	}
+
+	for ch := range img.Channels {
+		for i, expected := range img.Channels[ch] {
+			offset := position + (ch*len(img.Channels[ch])+i)*4
+			if v := math.Float32frombits(binary.LittleEndian.Uint32(file[offset:])); v != expected {
+				t.Errorf("channel %d pixel %d: expected %f, got %f", ch, i, expected, v)
+			}
+		}
+	}
+
+	keywords := header.Image.Keywords
+	if len(keywords) != 2 || keywords[0].Name != "OBJECT" || keywords[0].Value != `'M31 "Andromeda" & <friends>'` ||
+		keywords[1].Name != "HISTORY" || keywords[1].Comment != "stacked with starpack" {
+		t.Errorf("expected the OBJECT and HISTORY keywords, got %+v", keywords)
+	}
+}